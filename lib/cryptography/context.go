@@ -1,45 +1,129 @@
 package cryptography
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 
-	"github.com/agl/ed25519/edwards25519"
-	"golang.org/x/crypto/curve25519"
+	"github.com/agl/ed25519"
+	"github.com/majestrate/swarmserv/lib/encode"
 )
 
 // CryptoContext is a context for all encryption and signing
 type CryptoContext struct {
+	// privkey is our ed25519 seed
 	privkey [32]byte
+	// secret is the seed followed by the public key, the way lokinet and libsodium keep an ed25519 secret key
+	secret [ed25519.PrivateKeySize]byte
 }
 
 // ErrInvalidSeed indicates a error when the seed value for the CryptoContext is invalid
 var ErrInvalidSeed = errors.New("invalid seed")
 
+// ErrIdentityMismatch is returned when the public key in an identity file is not the one for its seed
+var ErrIdentityMismatch = errors.New("public key does not match seed")
+
 // EnsurePubKeyEqualTo returns true if the public key for our seed is equal to pk
 func (cc *CryptoContext) EnsurePubKeyEqualTo(pk []byte) bool {
-	var pub [32]byte
-	var h edwards25519.ExtendedGroupElement
-	edwards25519.GeScalarMultBase(&h, &cc.privkey)
-	h.ToBytes(&pub)
-	return subtle.ConstantTimeCompare(pk, pub[:]) == 1
+	return subtle.ConstantTimeCompare(pk, cc.PublicKey()) == 1
 }
 
 // LoadPrivateKey loads the encryption seed from disk by filename
+// identity files hold the ed25519 seed followed by the public key as one bencoded byte string, the way lokinet writes them
 func (cc *CryptoContext) LoadPrivateKey(filename string) error {
-	privkey, err := ioutil.ReadFile(filename)
-	if err == nil && len(privkey) >= 35 {
-		copy(cc.privkey[:], privkey[3:35])
-	} else if err == nil {
-		err = ErrInvalidSeed
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	v, err := encode.Bdecode(data)
+	if err != nil {
+		return fmt.Errorf("invalid identity file %s: %s", filename, err.Error())
+	}
+	secret, ok := v.(string)
+	if !ok || len(secret) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid identity file %s: expected a %d byte string: %s", filename, ed25519.PrivateKeySize, ErrInvalidSeed.Error())
+	}
+	err = cc.setSeed([]byte(secret[:32]))
+	if err != nil {
+		return err
+	}
+	if !cc.EnsurePubKeyEqualTo([]byte(secret[32:])) {
+		return fmt.Errorf("invalid identity file %s: %s", filename, ErrIdentityMismatch.Error())
 	}
-	return err
+	return nil
+}
+
+// GeneratePrivateKey makes a new random seed
+func (cc *CryptoContext) GeneratePrivateKey() error {
+	seed := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, seed)
+	if err != nil {
+		return err
+	}
+	return cc.setSeed(seed)
+}
+
+// SavePrivateKey writes our secret key to a new identity file in the same format LoadPrivateKey reads
+// an existing file is never overwritten
+func (cc *CryptoContext) SavePrivateKey(filename string) error {
+	data, err := encode.Bencode(cc.secret[:])
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writefull(f, data)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// setSeed sets our ed25519 seed and derives the rest of our secret key from it
+func (cc *CryptoContext) setSeed(seed []byte) error {
+	copy(cc.privkey[:], seed)
+	_, secret, err := ed25519.GenerateKey(bytes.NewReader(cc.privkey[:]))
+	if err != nil {
+		return err
+	}
+	cc.secret = *secret
+	return nil
+}
+
+// PublicKey gets our ed25519 public key
+func (cc *CryptoContext) PublicKey() []byte {
+	pub := make([]byte, ed25519.PublicKeySize)
+	copy(pub, cc.secret[32:])
+	return pub
+}
+
+// Sign makes an ed25519 signature over msg with our key, the same as lokinet's crypto_sign_detached
+func (cc *CryptoContext) Sign(msg []byte) []byte {
+	sig := ed25519.Sign(&cc.secret, msg)
+	return sig[:]
+}
+
+// Verify returns true if sig is a valid ed25519 signature over msg made by the holder of pubkey
+func Verify(pubkey, msg, sig []byte) bool {
+	if len(pubkey) != ed25519.PublicKeySize || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	var pk [ed25519.PublicKeySize]byte
+	var s [ed25519.SignatureSize]byte
+	copy(pk[:], pubkey)
+	copy(s[:], sig)
+	return ed25519.Verify(&pk, msg, &s)
 }
 
 // prevents short writes
@@ -58,7 +142,15 @@ func writefull(w io.Writer, buf []byte) (err error) {
 // ErrInvalidPubKeyHex is the error when we get an invalid public key as hex
 var ErrInvalidPubKeyHex = errors.New("invalid public key hex")
 
+// deriveSharedSecret does ecdh with a hex encoded x25519 public key or session id
 func (cc *CryptoContext) deriveSharedSecret(pk string) ([]byte, error) {
+	if len(pk) == 66 {
+		b, err := SessionIDToX25519(pk)
+		if err != nil {
+			return nil, err
+		}
+		return cc.SharedSecret(b)
+	}
 	b, err := hex.DecodeString(pk)
 	if err != nil {
 		return nil, err
@@ -66,70 +158,107 @@ func (cc *CryptoContext) deriveSharedSecret(pk string) ([]byte, error) {
 	if len(b) != 32 {
 		return nil, ErrInvalidPubKeyHex
 	}
-	var pub [32]byte
-	copy(pub[:], b[0:32])
-	var shared [32]byte
-	curve25519.ScalarMult(&shared, &cc.privkey, &pub)
-	return shared[:], nil
+	return cc.SharedSecret(b)
 }
 
-func (cc *CryptoContext) processCipherBlocks(shared, iv []byte, r io.Reader, w io.Writer) error {
-	// encrypt
-	block, err := aes.NewCipher(shared)
-	if err != nil {
-		return err
-	}
-	// TODO: multiple cipher blocks
-	enc := cipher.NewCBCEncrypter(block, iv)
-	outbuf := make([]byte, enc.BlockSize())
-	inbuf := make([]byte, enc.BlockSize())
-	readbuf := inbuf[:]
-	for err == nil {
-		n, err := r.Read(readbuf)
+// processCipherBlocks runs every block of r through a block mode and writes the result to w
+// a short last block is padded with zeros
+func processCipherBlocks(mode cipher.BlockMode, r io.Reader, w io.Writer) error {
+	buf := make([]byte, mode.BlockSize())
+	for {
+		n, err := io.ReadFull(r, buf)
 		if err == io.EOF {
+			return nil
+		} else if err == io.ErrUnexpectedEOF {
 			// zero out remaining buffer
-			for idx := range readbuf[n:] {
-				readbuf[idx] = 0
+			for idx := range buf[n:] {
+				buf[n+idx] = 0
 			}
-			n = enc.BlockSize()
-			err = nil
+		} else if err != nil {
+			return err
 		}
-		if err == nil {
-			if n < enc.BlockSize() {
-				readbuf = readbuf[n:]
-				continue
-			} else {
-				readbuf = inbuf[:]
-			}
-			enc.CryptBlocks(outbuf, inbuf)
-			err = writefull(w, outbuf)
+		mode.CryptBlocks(buf, buf)
+		err = writefull(w, buf)
+		if err != nil {
+			return err
+		}
+		if n < len(buf) {
+			return nil
 		}
 	}
-	return err
 }
 
 // DecryptFrom decrypts a message from a recipiant with public key
-func (cc *CryptoContext) DecryptFrom(pk string, body io.Reader, dest io.Writer) error {
+// returns which envelope it came in so replies can use the same one
+func (cc *CryptoContext) DecryptFrom(pk string, body io.Reader, dest io.Writer) (Envelope, error) {
 	shared, err := cc.deriveSharedSecret(pk)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	iv := make([]byte, 16)
-	_, err = io.ReadFull(body, iv)
+	var version [1]byte
+	_, err = io.ReadFull(body, version[:])
 	if err != nil {
-		return err
+		return 0, err
+	}
+	env := Envelope(version[0])
+	switch env {
+	case EnvelopeCBC:
+		err = decryptCBC(shared, body, dest)
+	case EnvelopeAESGCM:
+		err = decryptAESGCM(shared, body, dest)
+	default:
+		err = ErrUnknownEnvelope
 	}
-	return cc.processCipherBlocks(shared, iv, body, dest)
+	return env, err
 }
 
-// EncryptTo encrypts an io.Reader to and io.Writer using a shared secret generated for PK using AES CBC and generates a random IV
+// EncryptTo encrypts an io.Reader to an io.Writer for the recipiant with public key using DefaultEnvelope
 func (cc *CryptoContext) EncryptTo(pk string, body io.Reader, dest io.Writer) error {
+	return cc.EncryptWith(DefaultEnvelope, pk, body, dest)
+}
+
+// EncryptWith encrypts an io.Reader to an io.Writer for the recipiant with public key using envelope env
+func (cc *CryptoContext) EncryptWith(env Envelope, pk string, body io.Reader, dest io.Writer) error {
 	shared, err := cc.deriveSharedSecret(pk)
 	if err != nil {
 		return err
 	}
+	switch env {
+	case EnvelopeCBC, EnvelopeAESGCM:
+	default:
+		return ErrUnknownEnvelope
+	}
+	err = writefull(dest, []byte{byte(env)})
+	if err != nil {
+		return err
+	}
+	if env == EnvelopeCBC {
+		return encryptCBC(shared, body, dest)
+	}
+	return encryptAESGCM(shared, body, dest)
+}
+
+// decryptCBC decrypts a legacy envelope, the iv followed by aes cbc blocks using the shared secret as the key
+func decryptCBC(shared []byte, body io.Reader, dest io.Writer) error {
+	block, err := aes.NewCipher(shared)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, block.BlockSize())
+	_, err = io.ReadFull(body, iv)
+	if err != nil {
+		return err
+	}
+	return processCipherBlocks(cipher.NewCBCDecrypter(block, iv), body, dest)
+}
 
-	iv := make([]byte, 16)
+// encryptCBC makes a legacy envelope using AES CBC with a random IV
+func encryptCBC(shared []byte, body io.Reader, dest io.Writer) error {
+	block, err := aes.NewCipher(shared)
+	if err != nil {
+		return err
+	}
+	iv := make([]byte, block.BlockSize())
 	_, err = io.ReadFull(rand.Reader, iv)
 	if err != nil {
 		return err
@@ -139,5 +268,5 @@ func (cc *CryptoContext) EncryptTo(pk string, body io.Reader, dest io.Writer) er
 	if err != nil {
 		return err
 	}
-	return cc.processCipherBlocks(shared, iv, body, dest)
+	return processCipherBlocks(cipher.NewCBCEncrypter(block, iv), body, dest)
 }
@@ -0,0 +1,76 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// test vector 1 from RFC 8032, which is what libsodium and lokinet produce
+const (
+	rfc8032Seed   = "9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60"
+	rfc8032PubKey = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+	rfc8032Sig    = "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+)
+
+func TestSign(t *testing.T) {
+	seed, _ := hex.DecodeString(rfc8032Seed)
+	pub, _ := hex.DecodeString(rfc8032PubKey)
+	sig, _ := hex.DecodeString(rfc8032Sig)
+	cc := new(CryptoContext)
+	err := cc.setSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cc.PublicKey(), pub) || !cc.EnsurePubKeyEqualTo(pub) {
+		t.Fatalf("public key %x != %x", cc.PublicKey(), pub)
+	}
+	got := cc.Sign(nil)
+	if !bytes.Equal(got, sig) {
+		t.Fatalf("signature %x != %x", got, sig)
+	}
+	if !Verify(pub, nil, got) {
+		t.Fatal("signature does not verify")
+	}
+	if Verify(pub, []byte("x"), got) {
+		t.Fatal("signature verifies for another message")
+	}
+}
+
+func TestIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "identity.private")
+	cc := new(CryptoContext)
+	err = cc.GeneratePrivateKey()
+	if err == nil {
+		err = cc.SavePrivateKey(fname)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cc.SavePrivateKey(fname) == nil {
+		t.Fatal("overwrote an existing identity file")
+	}
+	loaded := new(CryptoContext)
+	err = loaded.LoadPrivateKey(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded.PublicKey(), cc.PublicKey()) {
+		t.Fatal("loaded a different key")
+	}
+	// flip a bit of the public key half
+	data, _ := ioutil.ReadFile(fname)
+	data[len(data)-1] ^= 1
+	ioutil.WriteFile(fname, data, 0600)
+	if loaded.LoadPrivateKey(fname) == nil {
+		t.Fatal("loaded an identity file whose public key does not match")
+	}
+}
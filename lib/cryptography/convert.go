@@ -0,0 +1,110 @@
+package cryptography
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/agl/ed25519/edwards25519"
+	"golang.org/x/crypto/curve25519"
+)
+
+// ErrInvalidEd25519Key is returned when converting something that is not a valid ed25519 public key
+var ErrInvalidEd25519Key = errors.New("invalid ed25519 public key")
+
+// ErrInvalidSessionID is returned when a session id is not 05 followed by a hex encoded x25519 public key
+var ErrInvalidSessionID = errors.New("invalid session id")
+
+// Ed25519PubKeyToX25519 converts an ed25519 public key to the x25519 public key for the same secret
+// the same as libsodium's crypto_sign_ed25519_pk_to_curve25519: u = (1 + y) / (1 - y)
+func Ed25519PubKeyToX25519(pk []byte) ([]byte, error) {
+	if len(pk) != 32 {
+		return nil, ErrInvalidEd25519Key
+	}
+	var edpk [32]byte
+	copy(edpk[:], pk)
+	var A edwards25519.ExtendedGroupElement
+	if !A.FromBytes(&edpk) || hasSmallOrder(&A) {
+		return nil, ErrInvalidEd25519Key
+	}
+	var y, one, num, den, u edwards25519.FieldElement
+	edwards25519.FeFromBytes(&y, &edpk)
+	edwards25519.FeOne(&one)
+	edwards25519.FeAdd(&num, &one, &y)
+	edwards25519.FeSub(&den, &one, &y)
+	edwards25519.FeInvert(&den, &den)
+	edwards25519.FeMul(&u, &num, &den)
+	var out [32]byte
+	edwards25519.FeToBytes(&out, &u)
+	return out[:], nil
+}
+
+// hasSmallOrder returns true if A is one of the 8 points whose order divides the cofactor, the identity included
+// they would give a shared secret anyone can guess
+func hasSmallOrder(A *edwards25519.ExtendedGroupElement) bool {
+	var p edwards25519.ProjectiveGroupElement
+	var c edwards25519.CompletedGroupElement
+	A.ToProjective(&p)
+	for i := 0; i < 3; i++ {
+		p.Double(&c)
+		c.ToProjective(&p)
+	}
+	// 8 * A is the identity (0, 1)
+	var b [32]byte
+	p.ToBytes(&b)
+	return b == [32]byte{1}
+}
+
+// SessionIDToX25519 gets the x25519 public key from a hex encoded session id
+func SessionIDToX25519(id string) ([]byte, error) {
+	if len(id) != 66 || !strings.HasPrefix(id, "05") {
+		return nil, ErrInvalidSessionID
+	}
+	pk, err := hex.DecodeString(id[2:])
+	if err != nil {
+		return nil, ErrInvalidSessionID
+	}
+	return pk, nil
+}
+
+// X25519PrivateKey gets the x25519 private key for our ed25519 seed
+// the same as libsodium's crypto_sign_ed25519_sk_to_curve25519: the clamped first half of sha512 of the seed
+func (cc *CryptoContext) X25519PrivateKey() [32]byte {
+	h := sha512.Sum512(cc.privkey[:])
+	var sk [32]byte
+	copy(sk[:], h[:32])
+	sk[0] &= 248
+	sk[31] &= 127
+	sk[31] |= 64
+	return sk
+}
+
+// X25519PublicKey gets our x25519 public key, the one other service nodes and clients encrypt to
+func (cc *CryptoContext) X25519PublicKey() []byte {
+	sk := cc.X25519PrivateKey()
+	var pk [32]byte
+	curve25519.ScalarBaseMult(&pk, &sk)
+	return pk[:]
+}
+
+// SharedSecret does x25519 ecdh between our key and an x25519 public key
+func (cc *CryptoContext) SharedSecret(pk []byte) ([]byte, error) {
+	if len(pk) != 32 {
+		return nil, ErrInvalidPubKeyHex
+	}
+	var pub, shared [32]byte
+	copy(pub[:], pk)
+	sk := cc.X25519PrivateKey()
+	curve25519.ScalarMult(&shared, &sk, &pub)
+	return shared[:], nil
+}
+
+// SharedSecretWithSnode does x25519 ecdh between our key and a service node's ed25519 identity key
+func (cc *CryptoContext) SharedSecretWithSnode(edpk []byte) ([]byte, error) {
+	pk, err := Ed25519PubKeyToX25519(edpk)
+	if err != nil {
+		return nil, err
+	}
+	return cc.SharedSecret(pk)
+}
@@ -0,0 +1,84 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// from libsodium's test/default/ed25519_convert.c
+const (
+	convertSeed      = "421151a459faeade3d247115f94aedae42318124095afabe4d1451a559faedee"
+	convertCurvePK   = "f1814f0e8ff1043d8a44d25babff3cedcae6c22c3edaa48f857ae70de2baae50"
+	convertCurveSK   = "8052030376d47112be7f73ed7a019293dd12ad910b654455798b4667d73de166"
+	convertNotOnEdPK = "0200000000000000000000000000000000000000000000000000000000000000"
+)
+
+// the encodings of the points of small order, from libsodium's crypto_sign/ed25519/ref10/open.c
+var smallOrderEdPKs = []string{
+	// the identity
+	"0100000000000000000000000000000000000000000000000000000000000000",
+	// order 2
+	"ecffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff7f",
+	// order 4
+	"0000000000000000000000000000000000000000000000000000000000000000",
+	"0000000000000000000000000000000000000000000000000000000000000080",
+	// order 8
+	"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc05",
+	"26e8958fc2b227b045c3f489f2ef98f0d5dfac05d3c63339b13802886d53fc85",
+	"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac037a",
+	"c7176a703d4dd84fba3c0b760d10670f2a2053fa2c39ccc64ec7fd7792ac03fa",
+}
+
+func TestEd25519ToX25519(t *testing.T) {
+	seed, _ := hex.DecodeString(convertSeed)
+	cc := new(CryptoContext)
+	err := cc.setSeed(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sk := cc.X25519PrivateKey()
+	if hex.EncodeToString(sk[:]) != convertCurveSK {
+		t.Fatalf("x25519 secret key %x", sk)
+	}
+	if hex.EncodeToString(cc.X25519PublicKey()) != convertCurvePK {
+		t.Fatalf("x25519 public key %x", cc.X25519PublicKey())
+	}
+	pk, err := Ed25519PubKeyToX25519(cc.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(pk) != convertCurvePK {
+		t.Fatalf("converted public key %x", pk)
+	}
+	for _, bad := range append(smallOrderEdPKs, convertNotOnEdPK) {
+		b, _ := hex.DecodeString(bad)
+		_, err = Ed25519PubKeyToX25519(b)
+		if err != ErrInvalidEd25519Key {
+			t.Fatalf("converted %s", bad)
+		}
+	}
+}
+
+func TestSharedSecretWithSnode(t *testing.T) {
+	a, _, b, _ := testPair()
+	ab, err := a.SharedSecretWithSnode(b.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ba, err := b.SharedSecretWithSnode(a.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ab, ba) {
+		t.Fatal("shared secrets differ")
+	}
+	session := "05" + hex.EncodeToString(b.X25519PublicKey())
+	viaSession, err := a.deriveSharedSecret(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(viaSession, ab) {
+		t.Fatal("session id shared secret differs")
+	}
+}
@@ -0,0 +1,89 @@
+package cryptography
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Envelope is the version byte in front of everything we encrypt, it says how the rest is encrypted
+type Envelope byte
+
+// EnvelopeCBC is AES CBC keyed by the raw shared secret with zero padding and no MAC, kept for legacy clients
+const EnvelopeCBC Envelope = 0
+
+// EnvelopeAESGCM is AES-256-GCM keyed by HKDF over the shared secret, a random nonce goes in front of the sealed data
+const EnvelopeAESGCM Envelope = 1
+
+// DefaultEnvelope is the envelope EncryptTo uses
+const DefaultEnvelope = EnvelopeAESGCM
+
+// ErrUnknownEnvelope is returned when decrypting or encrypting with an envelope version we do not know
+var ErrUnknownEnvelope = errors.New("unknown envelope version")
+
+// ErrDecryptFailed is returned when authenticated ciphertext does not verify
+var ErrDecryptFailed = errors.New("decryption failed")
+
+// aesgcmInfo binds keys derived for EnvelopeAESGCM to that envelope
+var aesgcmInfo = []byte("swarmserv envelope aes-256-gcm")
+
+// aesgcmFor derives the EnvelopeAESGCM key from a shared secret
+func aesgcmFor(shared []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, aesgcmInfo), key)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// envelopeAD is the additional data sealed with a message, so the version byte cannot be swapped
+func envelopeAD(env Envelope) []byte {
+	return []byte{byte(env)}
+}
+
+func decryptAESGCM(shared []byte, body io.Reader, dest io.Writer) error {
+	aead, err := aesgcmFor(shared)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if len(data) < aead.NonceSize() {
+		return ErrDecryptFailed
+	}
+	plaintext, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], envelopeAD(EnvelopeAESGCM))
+	if err != nil {
+		return ErrDecryptFailed
+	}
+	return writefull(dest, plaintext)
+}
+
+func encryptAESGCM(shared []byte, body io.Reader, dest io.Writer) error {
+	aead, err := aesgcmFor(shared)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return err
+	}
+	return writefull(dest, aead.Seal(nonce, nonce, data, envelopeAD(EnvelopeAESGCM)))
+}
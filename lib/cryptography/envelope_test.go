@@ -0,0 +1,70 @@
+package cryptography
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// testPair makes two contexts with fixed keys and gives the hex encoded public key of each
+func testPair() (*CryptoContext, string, *CryptoContext, string) {
+	a := new(CryptoContext)
+	b := new(CryptoContext)
+	aseed := make([]byte, 32)
+	bseed := make([]byte, 32)
+	for idx := range aseed {
+		aseed[idx] = byte(idx + 1)
+		bseed[idx] = byte(idx * 7)
+	}
+	a.setSeed(aseed)
+	b.setSeed(bseed)
+	return a, hex.EncodeToString(a.X25519PublicKey()), b, hex.EncodeToString(b.X25519PublicKey())
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	a, apub, b, bpub := testPair()
+	msg := []byte("hello swarm, this is more than one block long")
+	for _, env := range []Envelope{EnvelopeCBC, EnvelopeAESGCM} {
+		var ciphertext, plaintext bytes.Buffer
+		err := a.EncryptWith(env, bpub, bytes.NewReader(msg), &ciphertext)
+		if err != nil {
+			t.Fatalf("envelope %d: encrypt: %s", env, err)
+		}
+		got, err := b.DecryptFrom(apub, &ciphertext, &plaintext)
+		if err != nil {
+			t.Fatalf("envelope %d: decrypt: %s", env, err)
+		}
+		if got != env {
+			t.Fatalf("envelope %d: decrypted as envelope %d", env, got)
+		}
+		if !bytes.Equal(bytes.TrimRight(plaintext.Bytes(), "\x00"), msg) {
+			t.Fatalf("envelope %d: got %q", env, plaintext.Bytes())
+		}
+	}
+}
+
+func TestEnvelopeTampered(t *testing.T) {
+	a, apub, b, bpub := testPair()
+	var ciphertext bytes.Buffer
+	err := a.EncryptTo(bpub, bytes.NewReader([]byte("do not touch")), &ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := ciphertext.Bytes()
+	for idx := 1; idx < len(data); idx++ {
+		tampered := append([]byte(nil), data...)
+		tampered[idx] ^= 0x01
+		var plaintext bytes.Buffer
+		_, err = b.DecryptFrom(apub, bytes.NewReader(tampered), &plaintext)
+		if err != ErrDecryptFailed {
+			t.Fatalf("flipping byte %d: got %v", idx, err)
+		}
+	}
+	// downgrading the version byte must not decrypt to the same message either
+	tampered := append([]byte{byte(EnvelopeCBC)}, data[1:]...)
+	var plaintext bytes.Buffer
+	b.DecryptFrom(apub, bytes.NewReader(tampered), &plaintext)
+	if bytes.Contains(plaintext.Bytes(), []byte("do not touch")) {
+		t.Fatal("downgraded envelope decrypted")
+	}
+}
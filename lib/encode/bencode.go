@@ -0,0 +1,202 @@
+package encode
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// maxBencodeDepth is how deeply lists and dicts may nest when decoding
+const maxBencodeDepth = 64
+
+// BencodeError is returned when decoding malformed bencode, Offset is where in the input it went wrong
+type BencodeError struct {
+	Offset int
+	Msg    string
+}
+
+func (e *BencodeError) Error() string {
+	return fmt.Sprintf("malformed bencode at offset %d: %s", e.Offset, e.Msg)
+}
+
+// Bencode encodes a value as bencode
+// strings and byte slices become byte strings, integers become ints, slices become lists and maps with string keys become dicts
+func Bencode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := bencodeTo(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func bencodeTo(buf *bytes.Buffer, v interface{}) error {
+	switch val := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.WriteString(val)
+	case []byte:
+		buf.WriteString(strconv.Itoa(len(val)))
+		buf.WriteByte(':')
+		buf.Write(val)
+	case int:
+		fmt.Fprintf(buf, "i%de", val)
+	case int64:
+		fmt.Fprintf(buf, "i%de", val)
+	case uint64:
+		fmt.Fprintf(buf, "i%de", val)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range val {
+			err := bencodeTo(buf, item)
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		// dict keys are sorted as raw byte strings
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(buf, k)
+			err := bencodeTo(buf, val[k])
+			if err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("cannot bencode %T", v)
+	}
+	return nil
+}
+
+// Bdecode decodes one bencoded value that must take up all of data
+// byte strings decode to string, ints to int64, lists to []interface{} and dicts to map[string]interface{}
+func Bdecode(data []byte) (interface{}, error) {
+	d := &bdecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, d.errorf("trailing data")
+	}
+	return v, nil
+}
+
+type bdecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *bdecoder) errorf(format string, args ...interface{}) error {
+	return &BencodeError{Offset: d.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if depth > maxBencodeDepth {
+		return nil, d.errorf("nested too deeply")
+	}
+	if d.pos >= len(d.data) {
+		return nil, d.errorf("unexpected end of input")
+	}
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		return d.integer()
+	case c >= '0' && c <= '9':
+		return d.str()
+	case c == 'l':
+		d.pos++
+		list := []interface{}{}
+		for {
+			if d.pos >= len(d.data) {
+				return nil, d.errorf("unterminated list")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			item, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		last := ""
+		for {
+			if d.pos >= len(d.data) {
+				return nil, d.errorf("unterminated dict")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			if c := d.data[d.pos]; c < '0' || c > '9' {
+				return nil, d.errorf("dict key is not a byte string")
+			}
+			keypos := d.pos
+			key, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			if len(dict) > 0 && key <= last {
+				d.pos = keypos
+				return nil, d.errorf("dict key %q out of order", key)
+			}
+			last = key
+			dict[key], err = d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, d.errorf("unexpected byte %q", c)
+	}
+}
+
+// integer decodes i<digits>e
+func (d *bdecoder) integer() (int64, error) {
+	d.pos++
+	end := bytes.IndexByte(d.data[d.pos:], 'e')
+	if end < 0 {
+		return 0, d.errorf("unterminated int")
+	}
+	digits := string(d.data[d.pos : d.pos+end])
+	n, err := strconv.ParseInt(digits, 10, 64)
+	// only the canonical form is allowed, no leading zeros, plus signs or -0
+	if err != nil || strconv.FormatInt(n, 10) != digits {
+		return 0, d.errorf("invalid int %q", digits)
+	}
+	d.pos += end + 1
+	return n, nil
+}
+
+// str decodes <length>:<bytes>
+func (d *bdecoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", d.errorf("byte string without length")
+	}
+	digits := string(d.data[d.pos : d.pos+colon])
+	n, err := strconv.Atoi(digits)
+	if err != nil || strconv.Itoa(n) != digits {
+		return "", d.errorf("invalid byte string length %q", digits)
+	}
+	start := d.pos + colon + 1
+	if n > len(d.data)-start {
+		return "", d.errorf("byte string of %d bytes runs past end of input", n)
+	}
+	d.pos = start + n
+	return string(d.data[start:d.pos]), nil
+}
@@ -0,0 +1,55 @@
+package encode
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBencodeRoundTrip(t *testing.T) {
+	v := map[string]interface{}{
+		"s":    "\x00\x01binary",
+		"i":    int64(-42),
+		"list": []interface{}{int64(0), "x", []interface{}{}},
+		"dict": map[string]interface{}{"a": int64(1)},
+	}
+	data, err := Bencode(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "d4:dictd1:ai1ee1:ii-42e4:listli0e1:xlee1:s8:\x00\x01binarye"
+	if string(data) != expect {
+		t.Fatalf("encoded %q, expected %q", data, expect)
+	}
+	got, err := Bdecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, v) {
+		t.Fatalf("decoded %#v", got)
+	}
+}
+
+func TestBdecodeMalformed(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"i42",
+		"i042e",
+		"i-0e",
+		"i+1e",
+		"ie",
+		"5:abc",
+		"05:abcde",
+		"l",
+		"d1:ai1e",
+		"di1ei1ee",
+		"d1:bi1e1:ai2ee",
+		"d1:ai1e1:ai2ee",
+		"3:abcextra",
+		"x",
+	} {
+		_, err := Bdecode([]byte(in))
+		if _, ok := err.(*BencodeError); !ok {
+			t.Errorf("%q: expected a BencodeError, got %v", in, err)
+		}
+	}
+}
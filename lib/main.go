@@ -1,16 +1,20 @@
 package swarmserv
 
 import (
+	"encoding/hex"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/majestrate/swarmserv/lib/cryptography"
 	"github.com/majestrate/swarmserv/lib/encode"
 	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/server"
+	"github.com/majestrate/swarmserv/lib/swarm"
 	"github.com/majestrate/swarmserv/lib/version"
 )
 
@@ -18,11 +22,24 @@ const storageport = "8080"
 
 // Main is the main entry point for swarmserv daemon
 func Main() {
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		Keygen(os.Args[2:])
+		return
+	}
 	// TODO: override me on runtime somehow
 	dnshost := "127.3.2.1"
 	dnsport := "53"
 	seedfile := "identity.private"
 	dbroot := "storage"
+	maxTTL := server.DefaultMaxTTL
+	longPollTimeout := server.DefaultLongPollTimeout
+	maxSubscriptions := server.DefaultMaxSubscriptionsPerIP
+	retrieveLimit := server.DefaultRetrieveLimit
+	retrieveMaxBytes := server.DefaultRetrieveMaxBytes
+	snodeList := ""
+	lokidRPC := ""
+	signResponses := false
+	adminAddr := server.DefaultAdminAddr
 	idx := 0
 	// parse args
 	for idx < len(os.Args) {
@@ -37,6 +54,48 @@ func Main() {
 			if idx < len(os.Args) {
 				dbroot = os.Args[idx]
 			}
+		} else if arg == "--max-ttl" {
+			idx++
+			if idx < len(os.Args) {
+				maxTTL = parseSeconds(os.Args[idx], maxTTL)
+			}
+		} else if arg == "--long-poll-timeout" {
+			idx++
+			if idx < len(os.Args) {
+				longPollTimeout = parseSeconds(os.Args[idx], longPollTimeout)
+			}
+		} else if arg == "--max-subscriptions-per-ip" {
+			idx++
+			if idx < len(os.Args) {
+				maxSubscriptions = parseInt(os.Args[idx], maxSubscriptions)
+			}
+		} else if arg == "--retrieve-limit" {
+			idx++
+			if idx < len(os.Args) {
+				retrieveLimit = parseInt(os.Args[idx], retrieveLimit)
+			}
+		} else if arg == "--retrieve-max-bytes" {
+			idx++
+			if idx < len(os.Args) {
+				retrieveMaxBytes = parseInt(os.Args[idx], retrieveMaxBytes)
+			}
+		} else if arg == "--snode-list" {
+			idx++
+			if idx < len(os.Args) {
+				snodeList = os.Args[idx]
+			}
+		} else if arg == "--sign-responses" {
+			signResponses = true
+		} else if arg == "--admin-addr" {
+			idx++
+			if idx < len(os.Args) {
+				adminAddr = os.Args[idx]
+			}
+		} else if arg == "--lokid-rpc" {
+			idx++
+			if idx < len(os.Args) {
+				lokidRPC = os.Args[idx]
+			}
 		}
 		idx++
 	}
@@ -68,7 +127,21 @@ func Main() {
 	}
 
 	fmt.Println(version.Version)
-	serv := NewServer(dbroot)
+	serv := server.NewServer(dbroot)
+	serv.MaxTTL = maxTTL
+	serv.LongPollTimeout = longPollTimeout
+	serv.MaxSubscriptionsPerIP = maxSubscriptions
+	serv.RetrieveLimit = retrieveLimit
+	serv.RetrieveMaxBytes = retrieveMaxBytes
+	serv.Net = netctx
+	serv.Crypto = cryptoctx
+	serv.Signer = cryptoctx
+	serv.SignResponses = signResponses
+	if lokidRPC != "" {
+		serv.Swarm = swarm.New(swarm.NewLokidSource(lokidRPC), hex.EncodeToString(pk))
+	} else if snodeList != "" {
+		serv.Swarm = swarm.New(swarm.NewFileSource(snodeList), hex.EncodeToString(pk))
+	}
 	err = serv.Init()
 	if err != nil {
 		fmt.Printf("error during server init: %s", err.Error())
@@ -80,6 +153,19 @@ func Main() {
 			time.Sleep(time.Second * 10)
 		}
 	}()
+	if adminAddr != "" {
+		go func() {
+			fmt.Printf("admin endpoints going up on %s\n", adminAddr)
+			for {
+				l, err := net.Listen("tcp", adminAddr)
+				if err == nil {
+					err = serv.ServeAdmin(l)
+				}
+				fmt.Printf("admin listener: %s\n", err.Error())
+				time.Sleep(time.Second)
+			}
+		}()
+	}
 	server := &http.Server{
 		Handler: serv,
 		Addr:    net.JoinHostPort(snodeaddr, storageport),
@@ -93,3 +179,44 @@ func Main() {
 		}
 	}
 }
+
+// Keygen writes a new identity file for dev and test nodes, args may hold the file name
+func Keygen(args []string) {
+	seedfile := "identity.private"
+	if len(args) > 0 {
+		seedfile = args[0]
+	}
+	cryptoctx := new(cryptography.CryptoContext)
+	err := cryptoctx.GeneratePrivateKey()
+	if err == nil {
+		err = cryptoctx.SavePrivateKey(seedfile)
+	}
+	if err != nil {
+		fmt.Printf("keygen failed: %s\n", err.Error())
+		return
+	}
+	pk := cryptoctx.PublicKey()
+	fmt.Printf("wrote %s\n", seedfile)
+	fmt.Printf("pubkey: %s\n", hex.EncodeToString(pk))
+	fmt.Printf("address: %s.snode\n", encode.ZBase32Encoding.EncodeToString(pk))
+}
+
+// parseSeconds parses a duration given in seconds, returns fallback if it is invalid
+func parseSeconds(str string, fallback time.Duration) time.Duration {
+	n, err := strconv.ParseUint(str, 10, 64)
+	if err != nil {
+		fmt.Printf("invalid number of seconds: %s\n", str)
+		return fallback
+	}
+	return time.Duration(n) * time.Second
+}
+
+// parseInt parses a positive integer, returns fallback if it is invalid
+func parseInt(str string, fallback int) int {
+	n, err := strconv.Atoi(str)
+	if err != nil || n <= 0 {
+		fmt.Printf("invalid number: %s\n", str)
+		return fallback
+	}
+	return n
+}
@@ -1,12 +1,161 @@
 package model
 
+import "encoding/json"
+
 type Message struct {
 	Hash                string `json:"hash"`
 	ExpirationTimestamp uint64 `json:"expiration"`
+	Timestamp           uint64 `json:"timestamp"`
+	TTL                 uint64 `json:"ttl"`
+	Nonce               string `json:"nonce"`
+	Seq                 uint64 `json:"seq"`
 	Data                string `json:"data"`
 }
 
+// RetrieveRequest holds the params for the retrieve rpc method
+// Cursor is the cursor from a previous retrieve and takes precedence over LastHash
+// an unknown Cursor or LastHash retrieves the whole mailbox
+// Limit and MaxBytes cap the number of messages and total bytes of data returned, 0 uses the server's limits
 type RetrieveRequest struct {
 	PubKey   string `json:"pubKey"`
 	LastHash string `json:"lastHash"`
+	Cursor   string `json:"cursor"`
+	LongPoll bool   `json:"longPoll"`
+	Limit    int    `json:"limit"`
+	MaxBytes int    `json:"max_bytes"`
+}
+
+// RPCRequest is a request made to the json rpc storage endpoint
+type RPCRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// StoreRequest holds the params for the store rpc method
+type StoreRequest struct {
+	PubKey    string `json:"pubKey"`
+	TTL       string `json:"ttl"`
+	Nonce     string `json:"nonce"`
+	Timestamp string `json:"timestamp"`
+	Data      string `json:"data"`
+}
+
+// DeleteRequest holds the params for the delete rpc method
+// Timestamp is the unix time in seconds the request was signed at
+// Signature is the hex encoded ed25519 signature made by PubKey over "delete" followed by Timestamp and then each hash in Messages
+// if PubKey is a session id the signature is made by PubKeyEd25519, the hex encoded ed25519 key the session id comes from
+type DeleteRequest struct {
+	PubKey        string   `json:"pubKey"`
+	PubKeyEd25519 string   `json:"pubkey_ed25519,omitempty"`
+	Messages      []string `json:"messages"`
+	Timestamp     string   `json:"timestamp"`
+	Signature     string   `json:"signature"`
+}
+
+// DeleteAllRequest holds the params for the delete_all rpc method
+// Signature is the hex encoded ed25519 signature made by PubKey over "delete_all" followed by Timestamp
+// if PubKey is a session id the signature is made by PubKeyEd25519, the hex encoded ed25519 key the session id comes from
+type DeleteAllRequest struct {
+	PubKey        string `json:"pubKey"`
+	PubKeyEd25519 string `json:"pubkey_ed25519,omitempty"`
+	Timestamp     string `json:"timestamp"`
+	Signature     string `json:"signature"`
+}
+
+// ExpireRequest holds the params for the expire rpc method
+// Expiry is the new unix expiration timestamp in seconds
+// Timestamp is the unix time in seconds the request was signed at
+// Signature is the hex encoded ed25519 signature made by PubKey over "expire" followed by Expiry, Timestamp and then each hash in Messages
+// if PubKey is a session id the signature is made by PubKeyEd25519, the hex encoded ed25519 key the session id comes from
+type ExpireRequest struct {
+	PubKey        string   `json:"pubKey"`
+	PubKeyEd25519 string   `json:"pubkey_ed25519,omitempty"`
+	Messages      []string `json:"messages"`
+	Expiry        string   `json:"expiry"`
+	Timestamp     string   `json:"timestamp"`
+	Signature     string   `json:"signature"`
+}
+
+// GetSnodesRequest holds the params for the get_snodes_for_pubkey rpc method
+type GetSnodesRequest struct {
+	PubKey string `json:"pubKey"`
+}
+
+// PushRequest is a stored message pushed from one service node to another
+// Tombstone is set instead of Message to push a tombstone
+type PushRequest struct {
+	PubKey    string     `json:"pubKey"`
+	Message   Message    `json:"message"`
+	Tombstone *SyncEntry `json:"tombstone,omitempty"`
+}
+
+// Deletion is the signed delete or delete_all request that deleted a message
+// it is kept with the tombstone so other service nodes can check the recipient asked for it
+// Method is "delete" or "delete_all", Messages are the hashes signed with a delete
+// PubKeyEd25519 is the key that signed it if the recipient is a session id
+type Deletion struct {
+	Method        string   `json:"method"`
+	Messages      []string `json:"messages,omitempty"`
+	PubKeyEd25519 string   `json:"pubkey_ed25519,omitempty"`
+	Timestamp     string   `json:"timestamp"`
+	Signature     string   `json:"signature"`
+}
+
+// ExpiryChange is the signed expire request that last changed the expiration of a message
+// it is kept with the message so other service nodes can check the recipient asked for it
+// Messages are the hashes signed with the expire
+// PubKeyEd25519 is the key that signed it if the recipient is a session id
+type ExpiryChange struct {
+	Messages      []string `json:"messages"`
+	PubKeyEd25519 string   `json:"pubkey_ed25519,omitempty"`
+	Expiry        string   `json:"expiry"`
+	Timestamp     string   `json:"timestamp"`
+	Signature     string   `json:"signature"`
+}
+
+// SyncEntry describes a stored message or tombstone when syncing with other service nodes
+// Deletion is set for tombstones, ExpiryChange for messages whose expiration the recipient changed
+type SyncEntry struct {
+	PubKey              string        `json:"pubKey"`
+	Hash                string        `json:"hash"`
+	ExpirationTimestamp uint64        `json:"expiration"`
+	Deleted             bool          `json:"deleted"`
+	Deletion            *Deletion     `json:"deletion,omitempty"`
+	ExpiryChange        *ExpiryChange `json:"expiry_change,omitempty"`
+}
+
+// FetchRequest asks another service node for messages by hash
+type FetchRequest struct {
+	PubKey   string   `json:"pubKey"`
+	Messages []string `json:"messages"`
+}
+
+// StorageTestRequest challenges a peer to send us the message for PubKey with Hash
+type StorageTestRequest struct {
+	PubKey string `json:"pubKey"`
+	Hash   string `json:"hash"`
+}
+
+// OnionRequest is one layer of an onion request
+// Ciphertext is base64 encoded and encrypted to the service node with EphemeralKey, a hex encoded x25519 public key
+type OnionRequest struct {
+	Ciphertext   string `json:"ciphertext"`
+	EphemeralKey string `json:"ephemeral_key"`
+}
+
+// OnionHop is a decrypted onion request layer that is relayed to the service node with hex encoded ed25519 key Destination
+type OnionHop struct {
+	Destination string `json:"destination"`
+	OnionRequest
+}
+
+// OnionResponse is the reply to an onion request, Ciphertext is base64 encoded and encrypted to the layer's ephemeral key
+type OnionResponse struct {
+	Ciphertext string `json:"ciphertext"`
+}
+
+// OnionResult is what a client finds under the last layer of an onion response: the status and body of the storage rpc
+type OnionResult struct {
+	Status int    `json:"status"`
+	Body   string `json:"body"`
 }
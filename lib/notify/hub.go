@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"sync"
+)
+
+// Hub wakes up waiters when a new message is stored for a recipient
+type Hub struct {
+	access  sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}
+
+// NewHub creates a new empty notification hub
+func NewHub() *Hub {
+	return &Hub{
+		waiters: make(map[string]map[chan struct{}]bool),
+	}
+}
+
+// Subscribe returns a channel that is signaled each time a message is stored for owner
+// the caller must call Unsubscribe with the channel when done
+func (h *Hub) Subscribe(owner string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	h.access.Lock()
+	defer h.access.Unlock()
+	w, ok := h.waiters[owner]
+	if !ok {
+		w = make(map[chan struct{}]bool)
+		h.waiters[owner] = w
+	}
+	w[ch] = true
+	return ch
+}
+
+// Unsubscribe removes a channel obtained from Subscribe
+func (h *Hub) Unsubscribe(owner string, ch chan struct{}) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	w, ok := h.waiters[owner]
+	if !ok {
+		return
+	}
+	delete(w, ch)
+	if len(w) == 0 {
+		delete(h.waiters, owner)
+	}
+}
+
+// Notify wakes up everyone subscribed to owner, never blocks
+func (h *Hub) Notify(owner string) {
+	h.access.Lock()
+	defer h.access.Unlock()
+	for ch := range h.waiters[owner] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// already has a pending wakeup
+		}
+	}
+}
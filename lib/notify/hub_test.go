@@ -0,0 +1,55 @@
+package notify
+
+import (
+	"testing"
+)
+
+// signaled returns true if ch has a pending wakeup and consumes it
+func signaled(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubFanOut(t *testing.T) {
+	h := NewHub()
+	a := h.Subscribe("alice")
+	a2 := h.Subscribe("alice")
+	b := h.Subscribe("bob")
+	h.Notify("alice")
+	// a second notify before anyone wakes up must not block
+	h.Notify("alice")
+	if !signaled(a) || !signaled(a2) {
+		t.Error("not every subscriber of alice was woken up")
+	}
+	if signaled(a) || signaled(a2) {
+		t.Error("pending wakeups were not coalesced")
+	}
+	if signaled(b) {
+		t.Error("bob was woken up for alice's message")
+	}
+	h.Notify("nobody")
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	h := NewHub()
+	a := h.Subscribe("alice")
+	a2 := h.Subscribe("alice")
+	h.Unsubscribe("alice", a)
+	h.Notify("alice")
+	if signaled(a) {
+		t.Error("unsubscribed channel was woken up")
+	}
+	if !signaled(a2) {
+		t.Error("remaining subscriber was not woken up")
+	}
+	h.Unsubscribe("alice", a2)
+	// unsubscribing twice is harmless
+	h.Unsubscribe("alice", a2)
+	if len(h.waiters) != 0 {
+		t.Errorf("hub still has %d recipients after everyone unsubscribed", len(h.waiters))
+	}
+}
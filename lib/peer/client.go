@@ -0,0 +1,146 @@
+package peer
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// StatusError is returned when a peer replies with a non 200 status code
+type StatusError struct {
+	Code int
+	Body string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("peer replied with http %d: %s", e.Code, e.Body)
+}
+
+// Client makes requests to the storage servers of other service nodes
+type Client struct {
+	http   *http.Client
+	dialer *net.Dialer
+	signer Signer
+	reach  reachability
+	// signing holds the hex encoded pubkeys of the peers that have signed their replies to us
+	signing      map[string]bool
+	signingMutex sync.Mutex
+}
+
+// NewClient creates a peer client that dials out using netctx
+// if signer is not nil every request is signed with it so peers can tell who we are without a reverse lookup
+func NewClient(netctx *network.NetContext, signer Signer) *Client {
+	return &Client{
+		signer:  signer,
+		dialer:  netctx.Dialer,
+		signing: make(map[string]bool),
+		reach: reachability{
+			peers: make(map[string]*Reachability),
+		},
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext:     netctx.Dialer.DialContext,
+				MaxIdleConns:    32,
+				IdleConnTimeout: time.Minute,
+			},
+			Timeout: time.Second * 30,
+		},
+	}
+}
+
+// Post sends req as json to path on a service node and decodes the json reply into resp if it is not nil
+// returns a *StatusError if the node replied with a non 200 status code
+func (c *Client) Post(node swarm.ServiceNode, path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest(http.MethodPost, "http://"+node.HostPort()+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	c.sign(r, path, body)
+	return c.do(node, r, resp)
+}
+
+// Get fetches path from a service node and decodes the json reply into resp
+// returns a *StatusError if the node replied with a non 200 status code
+func (c *Client) Get(node swarm.ServiceNode, path string, resp interface{}) error {
+	r, err := http.NewRequest(http.MethodGet, "http://"+node.HostPort()+path, nil)
+	if err != nil {
+		return err
+	}
+	c.sign(r, path, nil)
+	return c.do(node, r, resp)
+}
+
+// sign adds a nonce for the reply signature and our signature headers to a request if we have a signer
+func (c *Client) sign(r *http.Request, path string, body []byte) {
+	r.Header.Set(NonceHeader, NewNonce())
+	if c.signer == nil {
+		return
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := c.signer.Sign(SignedMessage(r.Method, path, ts, body))
+	r.Header.Set(PubKeyHeader, hex.EncodeToString(c.signer.PublicKey()))
+	r.Header.Set(TimestampHeader, ts)
+	r.Header.Set(SignatureHeader, hex.EncodeToString(sig))
+}
+
+// signsReplies returns true if a peer has signed a reply to us before
+func (c *Client) signsReplies(pubkey string) bool {
+	c.signingMutex.Lock()
+	defer c.signingMutex.Unlock()
+	return c.signing[pubkey]
+}
+
+// markSigning remembers that a peer signs its replies so unsigned replies from it are refused from now on
+func (c *Client) markSigning(pubkey string) {
+	c.signingMutex.Lock()
+	defer c.signingMutex.Unlock()
+	c.signing[pubkey] = true
+}
+
+// do sends a request to a service node, a signed reply must be signed by that node
+// once a node signed a reply to us every later reply from it must be signed too
+func (c *Client) do(node swarm.ServiceNode, r *http.Request, resp interface{}) error {
+	res, err := c.http.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	var body []byte
+	if res.Header.Get(SignatureHeader) != "" || c.signsReplies(node.PubKey) {
+		pubkey, _ := hex.DecodeString(node.PubKey)
+		body, err = VerifyResponse(res, pubkey)
+		if err == nil {
+			c.markSigning(node.PubKey)
+		}
+	} else {
+		body, err = ioutil.ReadAll(res.Body)
+	}
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		if len(body) > 512 {
+			body = body[:512]
+		}
+		return &StatusError{Code: res.StatusCode, Body: string(body)}
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(body, resp)
+}
@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// ProbeInterval is how often we probe every peer in our swarm
+const ProbeInterval = time.Second * 30
+
+// probeTimeout is how long we wait to connect to a peer's storage port
+const probeTimeout = time.Second * 5
+
+// UnreachableAfter is how many probes in a row must fail before a peer is marked unreachable
+const UnreachableAfter = 3
+
+// Reachability is what our probes found out about a peer
+type Reachability struct {
+	Reachable bool `json:"reachable"`
+	// Latency is how long the last successful connect took in milliseconds
+	Latency int64 `json:"latency_ms"`
+	// Failures is how many probes in a row have failed
+	Failures      int    `json:"failures"`
+	TotalProbes   int    `json:"total_probes"`
+	TotalFailures int    `json:"total_failures"`
+	LastProbe     int64  `json:"last_probe"`
+	LastError     string `json:"last_error,omitempty"`
+}
+
+// reachability holds probe results keyed by hex encoded pubkey
+type reachability struct {
+	access sync.Mutex
+	peers  map[string]*Reachability
+}
+
+// RunProber probes every peer in our swarm forever
+func (c *Client) RunProber(sw *swarm.Swarm) {
+	for {
+		peers := sw.Peers()
+		for _, node := range peers {
+			c.Probe(node)
+		}
+		c.forgetAllBut(peers)
+		time.Sleep(ProbeInterval)
+	}
+}
+
+// Probe connects to a peer's storage port and records how it went
+func (c *Client) Probe(node swarm.ServiceNode) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	started := time.Now()
+	conn, err := c.dialer.DialContext(ctx, "tcp", node.HostPort())
+	latency := time.Since(started)
+	if err == nil {
+		conn.Close()
+	}
+	c.reach.access.Lock()
+	defer c.reach.access.Unlock()
+	r, ok := c.reach.peers[node.PubKey]
+	if !ok {
+		r = &Reachability{Reachable: true}
+		c.reach.peers[node.PubKey] = r
+	}
+	r.TotalProbes++
+	r.LastProbe = started.Unix()
+	if err == nil {
+		r.Reachable = true
+		r.Latency = int64(latency / time.Millisecond)
+		r.Failures = 0
+		r.LastError = ""
+		return nil
+	}
+	r.Failures++
+	r.TotalFailures++
+	r.LastError = err.Error()
+	if r.Reachable && r.Failures >= UnreachableAfter {
+		r.Reachable = false
+		fmt.Printf("[%s] marking %s unreachable after %d failed probes\n", time.Now().String(), node.HostPort(), r.Failures)
+	}
+	return err
+}
+
+// Reachable returns false if a peer has been marked unreachable, peers we have not probed yet are reachable
+func (c *Client) Reachable(node swarm.ServiceNode) bool {
+	c.reach.access.Lock()
+	defer c.reach.access.Unlock()
+	r, ok := c.reach.peers[node.PubKey]
+	return !ok || r.Reachable
+}
+
+// Reachability gets a copy of the probe results of every peer, keyed by hex encoded pubkey
+func (c *Client) Reachability() map[string]Reachability {
+	c.reach.access.Lock()
+	defer c.reach.access.Unlock()
+	peers := make(map[string]Reachability)
+	for pubkey, r := range c.reach.peers {
+		peers[pubkey] = *r
+	}
+	return peers
+}
+
+// forgetAllBut drops probe results of nodes that are no longer our peers
+func (c *Client) forgetAllBut(peers []swarm.ServiceNode) {
+	keep := make(map[string]bool)
+	for _, node := range peers {
+		keep[node.PubKey] = true
+	}
+	c.reach.access.Lock()
+	defer c.reach.access.Unlock()
+	for pubkey := range c.reach.peers {
+		if !keep[pubkey] {
+			delete(c.reach.peers, pubkey)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+func TestProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	node := swarm.ServiceNode{
+		PubKey:  "0000000000000000000000000000000000000000000000000000000000000002",
+		Address: "127.0.0.1",
+	}
+	node.Port, _ = strconv.Atoi(port)
+	c := NewClient(&network.NetContext{Dialer: new(net.Dialer)}, nil)
+	err = c.Probe(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing listens there any more
+	l.Close()
+	for i := 1; i <= UnreachableAfter; i++ {
+		if !c.Reachable(node) {
+			t.Fatalf("unreachable after %d failed probes", i-1)
+		}
+		if c.Probe(node) == nil {
+			t.Fatal("probe of a closed port passed")
+		}
+	}
+	if c.Reachable(node) {
+		t.Fatalf("reachable after %d failed probes", UnreachableAfter)
+	}
+	r := c.Reachability()[node.PubKey]
+	if r.Failures != UnreachableAfter || r.TotalProbes != UnreachableAfter+1 || r.LastError == "" {
+		t.Errorf("reachability %+v", r)
+	}
+	c.forgetAllBut(nil)
+	if !c.Reachable(node) {
+		t.Error("a node that left our swarm is still unreachable")
+	}
+}
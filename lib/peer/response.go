@@ -0,0 +1,84 @@
+package peer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/cryptography"
+)
+
+// signedResponseHeaders are the headers covered by a response signature along with the status and body
+var signedResponseHeaders = []string{"Content-Type", TimestampHeader}
+
+// NonceHeader holds a random hex string the client picked for a request, it is covered by the response signature
+// so that a signed reply cannot be replayed as the reply to another request
+const NonceHeader = "X-Loki-Snode-Nonce"
+
+// ErrUnsignedResponse is returned when verifying a response that has no signature
+var ErrUnsignedResponse = errors.New("response is not signed")
+
+// ErrBadResponseSignature is returned when a response signature was not made by the service node we asked
+var ErrBadResponseSignature = errors.New("bad response signature")
+
+// NewNonce makes a random value for NonceHeader
+func NewNonce() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// RequestHash is the hash of the request a response is for: the method, the request uri and the client's nonce
+func RequestHash(method, uri, nonce string) []byte {
+	h := sha256.Sum256([]byte(method + " " + uri + "\n" + nonce))
+	return h[:]
+}
+
+// ResponseHash is what gets signed for a response: the hash of the request it answers from RequestHash,
+// a hash of the status, the headers in signedResponseHeaders and a hash of the body
+func ResponseHash(request []byte, status int, header http.Header, body []byte) []byte {
+	h := sha256.New()
+	h.Write(request)
+	fmt.Fprintf(h, "%d\n", status)
+	for _, name := range signedResponseHeaders {
+		fmt.Fprintf(h, "%s: %s\n", name, header.Get(name))
+	}
+	b := sha256.Sum256(body)
+	h.Write(b[:])
+	return h.Sum(nil)
+}
+
+// SignResponse sets the timestamp and signature headers of a response to r that is about to be sent with status and body
+func SignResponse(signer Signer, r *http.Request, status int, header http.Header, body []byte) {
+	header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	request := RequestHash(r.Method, r.RequestURI, r.Header.Get(NonceHeader))
+	sig := signer.Sign(ResponseHash(request, status, header, body))
+	header.Set(SignatureHeader, hex.EncodeToString(sig))
+}
+
+// VerifyResponse reads the body of a response and checks that it was signed by the service node with ed25519 key pubkey
+// as the reply to the request it was sent for
+// returns the body
+func VerifyResponse(res *http.Response, pubkey []byte) ([]byte, error) {
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	sighex := res.Header.Get(SignatureHeader)
+	if sighex == "" {
+		return body, ErrUnsignedResponse
+	}
+	sig, err := hex.DecodeString(sighex)
+	r := res.Request
+	request := RequestHash(r.Method, r.URL.RequestURI(), r.Header.Get(NonceHeader))
+	if err != nil || !cryptography.Verify(pubkey, ResponseHash(request, res.StatusCode, res.Header, body), sig) {
+		return body, ErrBadResponseSignature
+	}
+	return body, nil
+}
@@ -0,0 +1,29 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// PubKeyHeader holds the hex encoded ed25519 key of the service node that signed a request
+const PubKeyHeader = "X-Loki-Snode-PubKey"
+
+// TimestampHeader holds the unix timestamp in seconds a request was signed at
+const TimestampHeader = "X-Loki-Snode-Timestamp"
+
+// SignatureHeader holds the hex encoded ed25519 signature over a request
+const SignatureHeader = "X-Loki-Snode-Signature"
+
+// Signer signs requests to other service nodes with our service node identity key
+type Signer interface {
+	// PublicKey gets our ed25519 public key
+	PublicKey() []byte
+	// Sign makes an ed25519 signature over msg
+	Sign(msg []byte) []byte
+}
+
+// SignedMessage is what gets signed for a request: the method, the request uri, the timestamp and a hash of the body
+func SignedMessage(method, uri, timestamp string, body []byte) []byte {
+	h := sha256.Sum256(body)
+	return []byte(method + " " + uri + "\n" + timestamp + "\n" + hex.EncodeToString(h[:]))
+}
@@ -25,7 +25,7 @@ func CheckPOW(nonce, timestamp, ttl, recipiant string, body io.Reader) (*model.M
 		return nil, err
 	}
 
-	_, err = strconv.ParseUint(timestamp, 10, 64)
+	ts_int, err := strconv.ParseUint(timestamp, 10, 64)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +70,18 @@ func CheckPOW(nonce, timestamp, ttl, recipiant string, body io.Reader) (*model.M
 		return &model.Message{
 			Hash:                hex.EncodeToString(hashresult),
 			ExpirationTimestamp: uint64(expiresAt.Unix()),
+			Timestamp:           ts_int,
+			TTL:                 ttl_int,
+			Nonce:               nonce,
 		}, nil
 	}
 	return nil, ErrBadPoW
 }
+
+// MessageHash computes the hex encoded hash of a message the same way CheckPOW does
+func MessageHash(timestamp, ttl, recipiant, data string) string {
+	h := sha512.New()
+	io.WriteString(h, timestamp+ttl+recipiant)
+	io.WriteString(h, data)
+	return hex.EncodeToString(h.Sum(nil))
+}
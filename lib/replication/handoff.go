@@ -0,0 +1,184 @@
+package replication
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// HandoffInterval is how often we look for recipients that no longer belong to our swarm
+const HandoffInterval = time.Minute * 5
+
+// ErrHandoffFailed is returned when no member of the new swarm took a message
+var ErrHandoffFailed = errors.New("no member of the new swarm took the message")
+
+// Handoff moves messages for recipients that stopped mapping to our swarm over to the swarm that owns them now
+// the hashes handed off so far are kept on disk, one file per recipient, so a restart picks up where it left off
+type Handoff struct {
+	root   string
+	swarm  *swarm.Swarm
+	client *peer.Client
+	store  storage.Store
+}
+
+// NewHandoff creates a handoff job that keeps its progress under rootdir
+func NewHandoff(rootdir string, sw *swarm.Swarm, client *peer.Client, store storage.Store) *Handoff {
+	return &Handoff{
+		root:   filepath.Join(rootdir, "handoff"),
+		swarm:  sw,
+		client: client,
+		store:  store,
+	}
+}
+
+// Init creates the progress directory
+func (h *Handoff) Init() error {
+	return os.MkdirAll(h.root, 0700)
+}
+
+// Run hands off messages forever
+func (h *Handoff) Run() {
+	for {
+		time.Sleep(HandoffInterval)
+		h.Tick()
+	}
+}
+
+// Tick hands off every recipient we are no longer responsible for
+func (h *Handoff) Tick() {
+	if _, ok := h.swarm.OurSwarm(); !ok {
+		// without a swarm of our own everything would look misplaced
+		return
+	}
+	owners, err := h.store.Owners()
+	if err != nil {
+		fmt.Printf("!!! [%s] cannot list recipients: %s\n", time.Now().String(), err.Error())
+		return
+	}
+	for _, owner := range owners {
+		if h.swarm.IsResponsibleFor(owner) {
+			// ours again, forget any handoff we started
+			os.Remove(filepath.Join(h.root, owner))
+			continue
+		}
+		err = h.handoff(owner)
+		if err != nil {
+			fmt.Printf("[%s] handoff of %s failed: %s\n", time.Now().String(), owner, err.Error())
+		}
+	}
+}
+
+// handoff pushes every message and tombstone for owner to the swarm it belongs to then removes them here
+// tombstones go too so the new swarm does not sync deleted messages back from nodes that still have them
+func (h *Handoff) handoff(owner string) error {
+	id, err := h.swarm.SwarmFor(owner)
+	if err != nil {
+		// not a key we can place anywhere, leave it to expire
+		return nil
+	}
+	members := h.swarm.MembersOf(id)
+	if len(members) == 0 {
+		return ErrHandoffFailed
+	}
+	progress := filepath.Join(h.root, owner)
+	done, err := readProgress(progress)
+	if err != nil {
+		return err
+	}
+	var reqs []model.PushRequest
+	err = h.store.IterAllFor(owner, func(msg model.Message) error {
+		if !done[msg.Hash] {
+			msg.Seq = 0
+			reqs = append(reqs, model.PushRequest{
+				PubKey:  owner,
+				Message: msg,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	tombstones, err := h.store.TombstonesFor(owner)
+	if err != nil {
+		return err
+	}
+	for idx := range tombstones {
+		if !done[tombstones[idx].Hash] {
+			reqs = append(reqs, model.PushRequest{
+				PubKey:    owner,
+				Tombstone: &tombstones[idx],
+			})
+		}
+	}
+	f, err := os.OpenFile(progress, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	for idx := range reqs {
+		hash := reqs[idx].Message.Hash
+		if reqs[idx].Tombstone != nil {
+			hash = reqs[idx].Tombstone.Hash
+		}
+		err = h.push(members, &reqs[idx])
+		if err == nil {
+			_, err = fmt.Fprintln(f, hash)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	f.Close()
+	err = h.store.ForgetAllFor(owner)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[%s] handed off %d messages and tombstones for %s to swarm %d\n", time.Now().String(), len(reqs)+len(done), owner, id)
+	return os.Remove(progress)
+}
+
+// push sends a message or tombstone to every member of a swarm, it is handed off once any of them has it
+func (h *Handoff) push(members []swarm.ServiceNode, req *model.PushRequest) error {
+	err := ErrHandoffFailed
+	for _, node := range members {
+		if !h.client.Reachable(node) {
+			continue
+		}
+		e := h.client.Post(node, PushPath, req, nil)
+		if se, ok := e.(*peer.StatusError); ok && se.Code == http.StatusConflict {
+			// they already have it
+			e = nil
+		}
+		if e == nil {
+			err = nil
+		}
+	}
+	return err
+}
+
+// readProgress loads the hashes already handed off from a progress file, a missing file means none
+func readProgress(fpath string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		done[scanner.Text()] = true
+	}
+	return done, scanner.Err()
+}
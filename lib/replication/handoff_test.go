@@ -0,0 +1,89 @@
+package replication
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// failNth is a push endpoint that fails the nth push it gets once
+type failNth struct {
+	pushRecorder
+	n int
+}
+
+func (f *failNth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.access.Lock()
+	f.failing = f.calls+1 == f.n
+	f.access.Unlock()
+	f.pushRecorder.ServeHTTP(w, r)
+}
+
+func TestHandoffResume(t *testing.T) {
+	dir, done := testDir(t)
+	defer done()
+	recorder := &failNth{n: 2}
+	node, stop := testPeer(recorder)
+	defer stop()
+	// testOwner is closer to the peer's swarm than to ours
+	node.SwarmID = 0x100
+	sw := testSwarm(t, dir, 0x1000, node)
+	store := testStore(t, dir, "ours")
+	expiresAt := uint64(time.Now().Add(time.Hour).Unix())
+	var hashes []string
+	for _, data := range []string{"one", "two", "three", "gone"} {
+		hashes = append(hashes, putTestMessage(t, store, testOwner, data, expiresAt))
+	}
+	h, _ := hex.DecodeString(hashes[3])
+	_, err := store.DeleteMessages(testOwner, [][]byte{h}, &model.Deletion{Method: "delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handoff := NewHandoff(dir, sw, testClient(), store)
+	err = handoff.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a previous run got the first one there
+	err = ioutil.WriteFile(filepath.Join(dir, "handoff", testOwner), []byte(hashes[0]+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handoff.Tick()
+	pushed := recorder.hashes()
+	if len(pushed) != 1 {
+		t.Fatalf("pushed %v before the failure, expected one", pushed)
+	}
+	owners, _ := store.Owners()
+	if len(owners) != 1 {
+		t.Fatal("forgot the recipient after a failed handoff")
+	}
+	progress, _ := ioutil.ReadFile(filepath.Join(dir, "handoff", testOwner))
+	if string(progress) != hashes[0]+"\n"+pushed[0]+"\n" {
+		t.Fatalf("progress file %q after the failure", progress)
+	}
+
+	handoff.Tick()
+	pushed = recorder.hashes()
+	sort.Strings(pushed)
+	expected := append([]string(nil), hashes[1:]...)
+	sort.Strings(expected)
+	if strings.Join(pushed, " ") != strings.Join(expected, " ") {
+		t.Fatalf("pushed %v expected each of %v once", pushed, expected)
+	}
+	owners, _ = store.Owners()
+	if len(owners) != 0 {
+		t.Errorf("still have %v after the handoff", owners)
+	}
+	if _, err = ioutil.ReadFile(filepath.Join(dir, "handoff", testOwner)); err == nil {
+		t.Error("progress file kept after the handoff")
+	}
+}
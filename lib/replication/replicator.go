@@ -0,0 +1,217 @@
+package replication
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// PushPath is the peer endpoint messages are pushed to
+const PushPath = "/v1/swarm/push"
+
+// retryInterval is how often we retry the queue when there is nothing new
+const retryInterval = time.Second * 5
+
+// minBackoff and maxBackoff bound how long we stop pushing to a peer after a failure
+const minBackoff = time.Second * 5
+const maxBackoff = time.Minute * 10
+
+// peerBackoff tracks failed pushes to a peer
+type peerBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// Replicator pushes newly stored messages to the other members of our swarm
+// pending pushes are queued on disk, one directory per peer, so they survive restarts
+type Replicator struct {
+	root    string
+	swarm   *swarm.Swarm
+	client  *peer.Client
+	store   storage.Store
+	wakeup  chan struct{}
+	access  sync.Mutex
+	backoff map[string]*peerBackoff
+}
+
+// NewReplicator creates a replicator that keeps its queue under rootdir
+func NewReplicator(rootdir string, sw *swarm.Swarm, client *peer.Client, store storage.Store) *Replicator {
+	return &Replicator{
+		root:    filepath.Join(rootdir, "replication"),
+		swarm:   sw,
+		client:  client,
+		store:   store,
+		wakeup:  make(chan struct{}, 1),
+		backoff: make(map[string]*peerBackoff),
+	}
+}
+
+// Init creates the queue directory
+func (r *Replicator) Init() error {
+	return os.MkdirAll(r.root, 0700)
+}
+
+// Enqueue queues the message for owner with hex encoded hash to be pushed to every peer in our swarm
+func (r *Replicator) Enqueue(owner, hash string) error {
+	for _, node := range r.swarm.Peers() {
+		dir := filepath.Join(r.root, node.PubKey)
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, hash), []byte(owner), 0600)
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case r.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run pushes queued messages forever
+func (r *Replicator) Run() {
+	ticker := time.NewTicker(retryInterval)
+	defer ticker.Stop()
+	for {
+		r.Tick()
+		select {
+		case <-r.wakeup:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Tick tries to push every queued message to peers that we are not backing off from
+func (r *Replicator) Tick() {
+	if !r.swarm.Ready() {
+		return
+	}
+	peers := make(map[string]swarm.ServiceNode)
+	for _, node := range r.swarm.Peers() {
+		peers[node.PubKey] = node
+	}
+	f, err := os.Open(r.root)
+	if err != nil {
+		fmt.Printf("!!! [%s] cannot open replication queue: %s\n", time.Now().String(), err.Error())
+		return
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		node, ok := peers[name]
+		if !ok {
+			// no longer in our swarm
+			os.RemoveAll(filepath.Join(r.root, name))
+			continue
+		}
+		if r.backingOff(name) || !r.client.Reachable(node) {
+			// keep the queue until they come back
+			continue
+		}
+		err = r.flushPeer(node)
+		r.recordResult(name, err)
+		if err != nil {
+			fmt.Printf("[%s] push to %s failed: %s\n", time.Now().String(), node.HostPort(), err.Error())
+		}
+	}
+}
+
+// flushPeer pushes everything queued for a peer, stops at the first failure
+func (r *Replicator) flushPeer(node swarm.ServiceNode) error {
+	dir := filepath.Join(r.root, node.PubKey)
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		entry := filepath.Join(dir, name)
+		owner, err := ioutil.ReadFile(entry)
+		if err != nil {
+			continue
+		}
+		err = r.push(node, string(owner), name)
+		if err != nil {
+			return err
+		}
+		os.Remove(entry)
+	}
+	return nil
+}
+
+// push sends one message to a peer, messages that are gone or that the peer already has count as pushed
+func (r *Replicator) push(node swarm.ServiceNode, owner, hash string) error {
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil
+	}
+	msg, err := r.store.GetMessageFor(owner, h)
+	if err == storage.ErrNoSuchMessage {
+		// expired or deleted before we got to it
+		return nil
+	} else if err != nil {
+		return err
+	}
+	msg.Seq = 0
+	err = r.client.Post(node, PushPath, &model.PushRequest{
+		PubKey:  owner,
+		Message: *msg,
+	}, nil)
+	if e, ok := err.(*peer.StatusError); ok {
+		switch e.Code {
+		case http.StatusConflict, http.StatusMisdirectedRequest, http.StatusBadRequest:
+			// they already have it, it is not theirs to store or they will never take it
+			return nil
+		}
+	}
+	return err
+}
+
+func (r *Replicator) backingOff(pubkey string) bool {
+	r.access.Lock()
+	defer r.access.Unlock()
+	b, ok := r.backoff[pubkey]
+	return ok && time.Now().Before(b.until)
+}
+
+// recordResult resets or grows the backoff for a peer after trying to push to it
+func (r *Replicator) recordResult(pubkey string, err error) {
+	r.access.Lock()
+	defer r.access.Unlock()
+	if err == nil {
+		delete(r.backoff, pubkey)
+		return
+	}
+	b, ok := r.backoff[pubkey]
+	if !ok {
+		b = new(peerBackoff)
+		r.backoff[pubkey] = b
+	}
+	wait := minBackoff << uint(b.failures)
+	if wait > maxBackoff || wait <= 0 {
+		wait = maxBackoff
+	} else {
+		b.failures++
+	}
+	b.until = time.Now().Add(wait)
+}
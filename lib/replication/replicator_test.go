@@ -0,0 +1,226 @@
+package replication
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// testOwner maps to 0xff in swarm space
+const testOwner = "0500000000000000000000000000000000000000000000000000000000000000ff"
+
+// ourPubKey and peerPubKey are the identity keys of us and the peer run by testPeer
+var ourPubKey = hex.EncodeToString(make([]byte, 31)) + "01"
+var peerPubKey = hex.EncodeToString(make([]byte, 31)) + "02"
+
+// testDir makes a new temp dir, call the returned func to remove it
+func testDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "swarmserv-replication")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// testStore makes a store under dir/name
+func testStore(t *testing.T, dir, name string) storage.Store {
+	s := storage.NewSkiplistStore(filepath.Join(dir, name))
+	err := s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// putTestMessage stores data for owner expiring at expiresAt and returns its hex hash
+func putTestMessage(t *testing.T, s storage.Store, owner, data string, expiresAt uint64) string {
+	h := sha256.Sum256([]byte(owner + data))
+	msg := &model.Message{
+		Hash:                hex.EncodeToString(h[:]),
+		Timestamp:           uint64(time.Now().Unix() * 1000),
+		TTL:                 3600 * 1000,
+		ExpirationTimestamp: expiresAt,
+		Data:                data,
+	}
+	err := putMessage(s, owner, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg.Hash
+}
+
+// putMessage stores msg for owner the way a PutFunc would
+func putMessage(s storage.Store, owner string, msg *model.Message) error {
+	fname := s.Mktemp()
+	err := ioutil.WriteFile(fname, []byte(msg.Data), 0600)
+	if err != nil {
+		return err
+	}
+	_, err = s.PutMessageFor(owner, msg, fname)
+	return err
+}
+
+// testPeer runs handler as a service node, returns it and a func to stop it
+func testPeer(handler http.Handler) (swarm.ServiceNode, func()) {
+	srv := httptest.NewServer(handler)
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return swarm.ServiceNode{
+		PubKey:  peerPubKey,
+		Address: host,
+		Port:    p,
+	}, srv.Close
+}
+
+// testSwarm makes a swarm view of nodes where we are in swarm ourSwarm
+func testSwarm(t *testing.T, dir string, ourSwarm uint64, nodes ...swarm.ServiceNode) *swarm.Swarm {
+	nodes = append(nodes, swarm.ServiceNode{
+		PubKey:  ourPubKey,
+		SwarmID: ourSwarm,
+	})
+	data, _ := json.Marshal(nodes)
+	fpath := filepath.Join(dir, "nodes.json")
+	err := ioutil.WriteFile(fpath, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := swarm.New(swarm.NewFileSource(fpath), ourPubKey)
+	err = sw.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sw
+}
+
+// testClient makes an unsigned peer client
+func testClient() *peer.Client {
+	return peer.NewClient(&network.NetContext{Dialer: new(net.Dialer)}, nil)
+}
+
+// pushRecorder is a push endpoint that fails while failing is set and records the hashes pushed to it otherwise
+type pushRecorder struct {
+	access  sync.Mutex
+	failing bool
+	calls   int
+	pushed  []string
+}
+
+func (p *pushRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.calls++
+	var req model.PushRequest
+	if r.URL.Path != PushPath || json.NewDecoder(r.Body).Decode(&req) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if p.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if req.Tombstone != nil {
+		p.pushed = append(p.pushed, req.Tombstone.Hash)
+	} else {
+		p.pushed = append(p.pushed, req.Message.Hash)
+	}
+}
+
+// setFailing sets whether pushes fail, returns how many pushes were made so far
+func (p *pushRecorder) setFailing(failing bool) int {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.failing = failing
+	return p.calls
+}
+
+func (p *pushRecorder) hashes() []string {
+	p.access.Lock()
+	defer p.access.Unlock()
+	return append([]string(nil), p.pushed...)
+}
+
+func TestReplicatorQueue(t *testing.T) {
+	dir, done := testDir(t)
+	defer done()
+	recorder := &pushRecorder{failing: true}
+	node, stop := testPeer(recorder)
+	defer stop()
+	node.SwarmID = 1
+	sw := testSwarm(t, dir, 1, node)
+	store := testStore(t, dir, "ours")
+	r := NewReplicator(dir, sw, testClient(), store)
+	err := r.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := putTestMessage(t, store, testOwner, "hello", uint64(time.Now().Add(time.Hour).Unix()))
+	err = r.Enqueue(testOwner, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued := filepath.Join(dir, "replication", peerPubKey, hash)
+
+	r.Tick()
+	if _, err = os.Stat(queued); err != nil {
+		t.Fatalf("queue entry gone after a failed push: %v", err)
+	}
+	if !r.backingOff(peerPubKey) {
+		t.Fatal("not backing off after a failed push")
+	}
+	calls := recorder.setFailing(false)
+	r.Tick()
+	if recorder.setFailing(false) != calls {
+		t.Fatal("pushed while backing off")
+	}
+
+	// a restart keeps the queue but forgets the backoff
+	r = NewReplicator(dir, sw, testClient(), store)
+	err = r.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Tick()
+	pushed := recorder.hashes()
+	if len(pushed) != 1 || pushed[0] != hash {
+		t.Fatalf("pushed %v after restart expected %s", pushed, hash)
+	}
+	if _, err = os.Stat(queued); !os.IsNotExist(err) {
+		t.Fatalf("queue entry kept after it was pushed: %v", err)
+	}
+}
+
+func TestBackoffGrows(t *testing.T) {
+	r := NewReplicator("", nil, nil, nil)
+	expected := minBackoff
+	for i := 0; i < 10; i++ {
+		r.recordResult(peerPubKey, ErrHandoffFailed)
+		wait := time.Until(r.backoff[peerPubKey].until)
+		if wait > expected || wait < expected-time.Second {
+			t.Fatalf("backoff %s after %d failures expected %s", wait, i+1, expected)
+		}
+		expected *= 2
+		if expected > maxBackoff {
+			expected = maxBackoff
+		}
+	}
+	r.recordResult(peerPubKey, nil)
+	if r.backingOff(peerPubKey) {
+		t.Error("still backing off after a push went through")
+	}
+}
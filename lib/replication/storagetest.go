@@ -0,0 +1,205 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/pow"
+	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// StorageTestPath is the peer endpoint storage test challenges are sent to
+const StorageTestPath = "/v1/swarm/storage_test"
+
+// StorageTestInterval is how often we challenge one of our peers
+const StorageTestInterval = time.Minute
+
+// storageTestGrace is how old a message must be before we expect peers to have it
+// this gives replication and sync time to get it there
+const storageTestGrace = time.Minute * 5
+
+// storageTestHistory is how many results we keep per peer
+const storageTestHistory = 32
+
+// ErrWrongContents is the result of a storage test a peer answered with the wrong message
+var ErrWrongContents = errors.New("peer sent the wrong message contents")
+
+// StorageTestResult is the outcome of one storage test
+type StorageTestResult struct {
+	Time   int64  `json:"time"`
+	Hash   string `json:"hash"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// StorageTestHistory is the storage test record of one peer
+type StorageTestHistory struct {
+	Passed  int                 `json:"passed"`
+	Failed  int                 `json:"failed"`
+	Results []StorageTestResult `json:"results"`
+}
+
+// StorageTester challenges peers in our swarm to prove they hold messages we hold for the same recipients
+type StorageTester struct {
+	swarm   *swarm.Swarm
+	client  *peer.Client
+	store   storage.Store
+	rand    *rand.Rand
+	access  sync.Mutex
+	history map[string]*StorageTestHistory
+}
+
+// NewStorageTester creates a storage tester
+func NewStorageTester(sw *swarm.Swarm, client *peer.Client, store storage.Store) *StorageTester {
+	return &StorageTester{
+		swarm:   sw,
+		client:  client,
+		store:   store,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		history: make(map[string]*StorageTestHistory),
+	}
+}
+
+// Run tests peers forever
+func (t *StorageTester) Run() {
+	for {
+		time.Sleep(StorageTestInterval)
+		t.Tick()
+	}
+}
+
+// Tick challenges one random peer with one random message
+func (t *StorageTester) Tick() {
+	var peers []swarm.ServiceNode
+	for _, node := range t.swarm.Peers() {
+		if t.client.Reachable(node) {
+			peers = append(peers, node)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+	node := peers[t.rand.Intn(len(peers))]
+	owner, msg, err := t.pickMessage()
+	if err != nil {
+		fmt.Printf("!!! [%s] cannot pick a message to test: %s\n", time.Now().String(), err.Error())
+		return
+	}
+	if msg == nil {
+		// nothing old enough to test with
+		return
+	}
+	err = t.Test(node, owner, msg)
+	if err != nil {
+		fmt.Printf("[%s] storage test of %s failed: %s\n", time.Now().String(), node.HostPort(), err.Error())
+	}
+}
+
+// pickMessage picks a random message for a random recipient of our swarm
+// returns a nil message if there is nothing to test with
+func (t *StorageTester) pickMessage() (string, *model.Message, error) {
+	owners, err := t.store.Owners()
+	if err != nil {
+		return "", nil, err
+	}
+	var ours []string
+	for _, owner := range owners {
+		if t.swarm.IsResponsibleFor(owner) {
+			ours = append(ours, owner)
+		}
+	}
+	if len(ours) == 0 {
+		return "", nil, nil
+	}
+	owner := ours[t.rand.Intn(len(ours))]
+	oldest := uint64(time.Now().Add(-storageTestGrace).Unix())
+	soonest := uint64(time.Now().Add(storageTestGrace).Unix())
+	var msgs []model.Message
+	err = t.store.IterAllFor(owner, func(msg model.Message) error {
+		// message timestamps are in milliseconds
+		if msg.Timestamp/1000 <= oldest && msg.ExpirationTimestamp > soonest {
+			msgs = append(msgs, msg)
+		}
+		return nil
+	})
+	if err != nil || len(msgs) == 0 {
+		return "", nil, err
+	}
+	return owner, &msgs[t.rand.Intn(len(msgs))], nil
+}
+
+// Test challenges a peer to send us the message for owner that we have and records the result
+// returns nil if it passed
+func (t *StorageTester) Test(node swarm.ServiceNode, owner string, msg *model.Message) error {
+	err := t.challenge(node, owner, msg)
+	t.record(node, msg.Hash, err)
+	return err
+}
+
+// challenge asks a peer for a message and checks it matches ours
+func (t *StorageTester) challenge(node swarm.ServiceNode, owner string, msg *model.Message) error {
+	var resp model.Message
+	err := t.client.Post(node, StorageTestPath, &model.StorageTestRequest{
+		PubKey: owner,
+		Hash:   msg.Hash,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	if resp.Hash != msg.Hash || resp.Data != msg.Data {
+		return ErrWrongContents
+	}
+	if pow.MessageHash(fmt.Sprintf("%d", resp.Timestamp), fmt.Sprintf("%d", resp.TTL), owner, resp.Data) != msg.Hash {
+		return ErrWrongContents
+	}
+	return nil
+}
+
+// record keeps the result of a storage test of a peer
+func (t *StorageTester) record(node swarm.ServiceNode, hash string, err error) {
+	result := StorageTestResult{
+		Time:   time.Now().Unix(),
+		Hash:   hash,
+		Passed: err == nil,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	t.access.Lock()
+	defer t.access.Unlock()
+	h, ok := t.history[node.PubKey]
+	if !ok {
+		h = new(StorageTestHistory)
+		t.history[node.PubKey] = h
+	}
+	if result.Passed {
+		h.Passed++
+	} else {
+		h.Failed++
+	}
+	h.Results = append(h.Results, result)
+	if len(h.Results) > storageTestHistory {
+		h.Results = h.Results[len(h.Results)-storageTestHistory:]
+	}
+}
+
+// History gets a copy of the storage test record of every peer we tested, keyed by hex encoded pubkey
+func (t *StorageTester) History() map[string]StorageTestHistory {
+	t.access.Lock()
+	defer t.access.Unlock()
+	history := make(map[string]StorageTestHistory)
+	for pubkey, h := range t.history {
+		history[pubkey] = StorageTestHistory{
+			Passed:  h.Passed,
+			Failed:  h.Failed,
+			Results: append([]StorageTestResult(nil), h.Results...),
+		}
+	}
+	return history
+}
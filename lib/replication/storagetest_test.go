@@ -0,0 +1,131 @@
+package replication
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/pow"
+	"github.com/majestrate/swarmserv/lib/storage"
+)
+
+// testMessage makes a message for owner sent now with a valid hash
+func testMessage(owner, data string) *model.Message {
+	return testMessageSentAt(owner, data, time.Now())
+}
+
+// testMessageSentAt makes a message for owner sent at sent with a valid hash, it expires an hour after that
+func testMessageSentAt(owner, data string, sent time.Time) *model.Message {
+	msg := &model.Message{
+		Timestamp:           uint64(sent.Unix() * 1000),
+		TTL:                 3600 * 1000,
+		ExpirationTimestamp: uint64(sent.Add(time.Hour).Unix()),
+		Data:                data,
+	}
+	msg.Hash = pow.MessageHash(fmt.Sprintf("%d", msg.Timestamp), fmt.Sprintf("%d", msg.TTL), owner, msg.Data)
+	return msg
+}
+
+func TestStorageTest(t *testing.T) {
+	kept := testMessage(testOwner, "kept")
+	lost := testMessage(testOwner, "lost")
+	missing := testMessage(testOwner, "missing")
+	// the peer has kept and only the hash of lost
+	replies := map[string]model.Message{
+		kept.Hash: *kept,
+		lost.Hash: {
+			Hash:      lost.Hash,
+			Timestamp: lost.Timestamp,
+			TTL:       lost.TTL,
+			Data:      "forged",
+		},
+	}
+	node, stop := testPeer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req model.StorageTestRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		reply, ok := replies[req.Hash]
+		if r.URL.Path != StorageTestPath || req.PubKey != testOwner || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer stop()
+	tester := NewStorageTester(nil, testClient(), nil)
+
+	err := tester.Test(node, testOwner, kept)
+	if err != nil {
+		t.Fatalf("storage test failed: %s", err.Error())
+	}
+	err = tester.Test(node, testOwner, lost)
+	if err != ErrWrongContents {
+		t.Fatalf("storage test with the wrong data gave %v", err)
+	}
+	err = tester.Test(node, testOwner, missing)
+	if err == nil {
+		t.Fatal("storage test of a message they do not have passed")
+	}
+
+	h := tester.History()[peerPubKey]
+	if h.Passed != 1 || h.Failed != 2 || len(h.Results) != 3 {
+		t.Fatalf("history %+v", h)
+	}
+	if !h.Results[0].Passed || h.Results[1].Error != ErrWrongContents.Error() {
+		t.Errorf("results %+v", h.Results)
+	}
+}
+
+func TestStorageTestTick(t *testing.T) {
+	dir, done := testDir(t)
+	defer done()
+	theirs := testStore(t, dir, "theirs")
+	node, stop := testPeer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req model.StorageTestRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		h, _ := hex.DecodeString(req.Hash)
+		msg, err := theirs.GetMessageFor(req.PubKey, h)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(msg)
+	}))
+	defer stop()
+	node.SwarmID = 1
+	sw := testSwarm(t, dir, 1, node)
+	ours := testStore(t, dir, "ours")
+	tester := NewStorageTester(sw, testClient(), ours)
+
+	// too new for the peer to be expected to have it
+	fresh := testMessage(testOwner, "fresh")
+	for _, s := range []storage.Store{ours, theirs} {
+		err := putMessage(s, testOwner, fresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, msg, err := tester.pickMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != nil {
+		t.Fatalf("picked %s which was sent just now", msg.Hash)
+	}
+
+	old := testMessageSentAt(testOwner, "old", time.Now().Add(-storageTestGrace*2))
+	for _, s := range []storage.Store{ours, theirs} {
+		err = putMessage(s, testOwner, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tester.Tick()
+	h := tester.History()[peerPubKey]
+	if h.Passed != 1 || len(h.Results) != 1 || h.Results[0].Hash != old.Hash {
+		t.Fatalf("history %+v after a tick expected one pass with %s", h, old.Hash)
+	}
+}
@@ -0,0 +1,285 @@
+package replication
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// DigestsPath is the peer endpoint that gives a digest of every storage bucket
+const DigestsPath = "/v1/swarm/sync/digests"
+
+// BucketPath is the peer endpoint that lists the messages and tombstones in a storage bucket
+const BucketPath = "/v1/swarm/sync/bucket"
+
+// FetchPath is the peer endpoint messages are pulled from by hash
+const FetchPath = "/v1/swarm/sync/fetch"
+
+// SyncInterval is how often we sync with every peer in our swarm
+const SyncInterval = time.Minute * 2
+
+// fetchBatch is the most messages pulled in one request
+const fetchBatch = 64
+
+// DigestsResponse is the reply from DigestsPath
+type DigestsResponse struct {
+	Buckets map[string]string `json:"buckets"`
+}
+
+// BucketResponse is the reply from BucketPath
+type BucketResponse struct {
+	Entries []model.SyncEntry `json:"entries"`
+}
+
+// FetchResponse is the reply from FetchPath
+type FetchResponse struct {
+	Messages []model.Message `json:"messages"`
+}
+
+// PutFunc stores a message pulled from a peer
+type PutFunc func(owner string, msg *model.Message) error
+
+// VerifyDeletionFunc checks that the recipient signed the deletion of the message for owner with hash
+type VerifyDeletionFunc func(owner string, hash []byte, del *model.Deletion) error
+
+// VerifyExpiryFunc checks that the recipient signed the change of the expiration of the message for owner with hash
+type VerifyExpiryFunc func(owner string, hash []byte, change *model.ExpiryChange) error
+
+// Syncer periodically reconciles our storage with the other members of our swarm
+// buckets whose digests differ are listed and we pull the messages and tombstones we are missing
+type Syncer struct {
+	// MaxTTL caps how far in the future tombstones and expiration changes pulled from peers expire, 0 means no cap
+	MaxTTL time.Duration
+
+	swarm        *swarm.Swarm
+	client       *peer.Client
+	store        storage.Store
+	put          PutFunc
+	verify       VerifyDeletionFunc
+	verifyExpiry VerifyExpiryFunc
+}
+
+// NewSyncer creates a syncer that stores pulled messages with put
+// it only applies tombstones verify accepts and expiration changes verifyExpiry accepts
+func NewSyncer(sw *swarm.Swarm, client *peer.Client, store storage.Store, put PutFunc, verify VerifyDeletionFunc, verifyExpiry VerifyExpiryFunc) *Syncer {
+	return &Syncer{
+		swarm:        sw,
+		client:       client,
+		store:        store,
+		put:          put,
+		verify:       verify,
+		verifyExpiry: verifyExpiry,
+	}
+}
+
+// capExpiry caps an expiration timestamp from a peer to MaxTTL from now
+func (s *Syncer) capExpiry(expiresAt uint64) uint64 {
+	if s.MaxTTL == 0 {
+		return expiresAt
+	}
+	max := uint64(time.Now().Add(s.MaxTTL).Unix())
+	if expiresAt > max {
+		return max
+	}
+	return expiresAt
+}
+
+// signedExpiry gets the expiration an expiration change sets, capped at MaxTTL from when it was signed
+// the same as the service node that got the request caps it
+func (s *Syncer) signedExpiry(change *model.ExpiryChange) (uint64, error) {
+	expiresAt, err := strconv.ParseUint(change.Expiry, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	ts, err := strconv.ParseUint(change.Timestamp, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	max := ts + uint64(s.MaxTTL/time.Second)
+	if s.MaxTTL != 0 && expiresAt > max {
+		return max, nil
+	}
+	return expiresAt, nil
+}
+
+// newerExpiryChange returns true if the expiration change a was signed after b
+// changes signed in the same second are ordered by signature so every node picks the same one
+func newerExpiryChange(a, b *model.ExpiryChange) bool {
+	if b == nil {
+		return true
+	}
+	ta, err := strconv.ParseUint(a.Timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	tb, err := strconv.ParseUint(b.Timestamp, 10, 64)
+	if err != nil {
+		return true
+	}
+	if ta != tb {
+		return ta > tb
+	}
+	return a.Signature > b.Signature
+}
+
+// Run syncs with our peers forever
+func (s *Syncer) Run() {
+	for {
+		time.Sleep(SyncInterval)
+		s.Tick()
+	}
+}
+
+// Tick syncs with every peer in our swarm once
+func (s *Syncer) Tick() {
+	for _, node := range s.swarm.Peers() {
+		if !s.client.Reachable(node) {
+			continue
+		}
+		err := s.SyncWith(node)
+		if err != nil {
+			fmt.Printf("[%s] sync with %s failed: %s\n", time.Now().String(), node.HostPort(), err.Error())
+		}
+	}
+}
+
+// SyncWith pulls everything a peer has that we are missing
+func (s *Syncer) SyncWith(node swarm.ServiceNode) error {
+	var theirs DigestsResponse
+	err := s.client.Get(node, DigestsPath, &theirs)
+	if err != nil {
+		return err
+	}
+	ours, err := s.store.BucketDigests()
+	if err != nil {
+		return err
+	}
+	for bucket, digest := range theirs.Buckets {
+		if ours[bucket] == digest {
+			continue
+		}
+		err = s.syncBucket(node, bucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Syncer) syncBucket(node swarm.ServiceNode, bucket string) error {
+	var theirs BucketResponse
+	err := s.client.Get(node, BucketPath+"?bucket="+url.QueryEscape(bucket), &theirs)
+	if err != nil {
+		return err
+	}
+	ours, err := s.store.BucketEntries(bucket)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]model.SyncEntry)
+	for _, e := range ours {
+		have[e.PubKey+" "+e.Hash] = e
+	}
+	missing := make(map[string][]string)
+	var changes []model.SyncEntry
+	now := uint64(time.Now().Unix())
+	for _, e := range theirs.Entries {
+		if e.ExpirationTimestamp <= now || !s.swarm.IsResponsibleFor(e.PubKey) {
+			continue
+		}
+		mine, ok := have[e.PubKey+" "+e.Hash]
+		if e.Deleted {
+			if ok && mine.Deleted {
+				continue
+			}
+			hash, err := hex.DecodeString(e.Hash)
+			if err != nil {
+				continue
+			}
+			err = s.verify(e.PubKey, hash, e.Deletion)
+			if err != nil {
+				fmt.Printf("[%s] ignoring tombstone %s from %s: %s\n", time.Now().String(), e.Hash, node.HostPort(), err.Error())
+				continue
+			}
+			err = s.store.PutTombstoneFor(e.PubKey, hash, s.capExpiry(e.ExpirationTimestamp), e.Deletion)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !ok {
+			missing[e.PubKey] = append(missing[e.PubKey], e.Hash)
+		} else if mine.Deleted {
+			continue
+		}
+		if e.ExpiryChange != nil && newerExpiryChange(e.ExpiryChange, mine.ExpiryChange) {
+			// the recipient's newest expire wins so every node ends up with the same expiration
+			changes = append(changes, e)
+		}
+	}
+	for owner, hashes := range missing {
+		for len(hashes) > 0 {
+			n := len(hashes)
+			if n > fetchBatch {
+				n = fetchBatch
+			}
+			err = s.fetch(node, owner, hashes[:n])
+			if err != nil {
+				return err
+			}
+			hashes = hashes[n:]
+		}
+	}
+	// after fetching so messages we were missing get their expiration changed too
+	for _, e := range changes {
+		err = s.applyExpiryChange(node, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyExpiryChange sets the expiration of a message we have to the one the recipient signed in a peer's entry
+func (s *Syncer) applyExpiryChange(node swarm.ServiceNode, e model.SyncEntry) error {
+	hash, err := hex.DecodeString(e.Hash)
+	if err != nil {
+		return nil
+	}
+	expiresAt, err := s.signedExpiry(e.ExpiryChange)
+	if err == nil {
+		err = s.verifyExpiry(e.PubKey, hash, e.ExpiryChange)
+	}
+	if err != nil {
+		fmt.Printf("[%s] ignoring expiration change of %s from %s: %s\n", time.Now().String(), e.Hash, node.HostPort(), err.Error())
+		return nil
+	}
+	_, err = s.store.UpdateExpiry(e.PubKey, [][]byte{hash}, expiresAt, e.ExpiryChange)
+	return err
+}
+
+// fetch pulls messages for owner by hash from a peer and stores them
+func (s *Syncer) fetch(node swarm.ServiceNode, owner string, hashes []string) error {
+	var resp FetchResponse
+	err := s.client.Post(node, FetchPath, &model.FetchRequest{
+		PubKey:   owner,
+		Messages: hashes,
+	}, &resp)
+	if err != nil {
+		return err
+	}
+	for idx := range resp.Messages {
+		err = s.put(owner, &resp.Messages[idx])
+		if err != nil {
+			fmt.Printf("[%s] cannot store synced message %s: %s\n", time.Now().String(), resp.Messages[idx].Hash, err.Error())
+		}
+	}
+	return nil
+}
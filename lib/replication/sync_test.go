@@ -0,0 +1,206 @@
+package replication
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/storage"
+)
+
+// syncPeer serves the sync endpoints from a store like a peer would
+func syncPeer(t *testing.T, store storage.Store) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case DigestsPath:
+			buckets, err := store.BucketDigests()
+			if err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(DigestsResponse{Buckets: buckets})
+		case BucketPath:
+			entries, err := store.BucketEntries(r.URL.Query().Get("bucket"))
+			if err != nil {
+				t.Error(err)
+			}
+			json.NewEncoder(w).Encode(BucketResponse{Entries: entries})
+		case FetchPath:
+			var req model.FetchRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			var resp FetchResponse
+			for _, hash := range req.Messages {
+				h, _ := hex.DecodeString(hash)
+				msg, err := store.GetMessageFor(req.PubKey, h)
+				if err == nil {
+					resp.Messages = append(resp.Messages, *msg)
+				}
+			}
+			json.NewEncoder(w).Encode(resp)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func TestSyncWith(t *testing.T) {
+	dir, done := testDir(t)
+	defer done()
+	ours := testStore(t, dir, "ours")
+	theirs := testStore(t, dir, "theirs")
+	node, stop := testPeer(syncPeer(t, theirs))
+	defer stop()
+	node.SwarmID = 1
+	sw := testSwarm(t, dir, 1, node)
+
+	now := time.Now()
+	soon := uint64(now.Add(time.Hour).Unix())
+	later := uint64(now.Add(time.Hour * 2).Unix())
+	maxTTL := time.Hour * 3
+	// changeExpiry sets the expiration of a message in a store like an expire signed at signedAt would
+	changeExpiry := func(store storage.Store, hash string, expiresAt uint64, signedAt time.Time, sig string) {
+		h, _ := hex.DecodeString(hash)
+		_, err := store.UpdateExpiry(testOwner, [][]byte{h}, expiresAt, &model.ExpiryChange{
+			Messages:  []string{hash},
+			Expiry:    strconv.FormatUint(expiresAt, 10),
+			Timestamp: strconv.FormatInt(signedAt.Unix(), 10),
+			Signature: sig,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// both have it but the recipient extended theirs
+	extended := putTestMessage(t, ours, testOwner, "extended", soon)
+	putTestMessage(t, theirs, testOwner, "extended", soon)
+	changeExpiry(theirs, extended, later, now, "extended")
+	// we extended it but the recipient shortened theirs after that
+	shortened := putTestMessage(t, ours, testOwner, "shortened", soon)
+	putTestMessage(t, theirs, testOwner, "shortened", soon)
+	changeExpiry(ours, shortened, later, now.Add(-time.Minute), "extended")
+	changeExpiry(theirs, shortened, soon, now, "shortened")
+	// they extended theirs before the recipient shortened ours
+	stale := putTestMessage(t, ours, testOwner, "stale", soon)
+	putTestMessage(t, theirs, testOwner, "stale", soon)
+	changeExpiry(ours, stale, soon, now, "shortened")
+	changeExpiry(theirs, stale, later, now.Add(-time.Minute), "extended")
+	// they extended theirs without the recipient asking
+	unsigned := putTestMessage(t, ours, testOwner, "unsigned", soon)
+	putTestMessage(t, theirs, testOwner, "unsigned", soon)
+	h, _ := hex.DecodeString(unsigned)
+	_, err := theirs.UpdateExpiry(testOwner, [][]byte{h}, later, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := putTestMessage(t, ours, testOwner, "forged", soon)
+	putTestMessage(t, theirs, testOwner, "forged", soon)
+	changeExpiry(theirs, forged, later, now, "forged")
+	// extended further than MaxTTL after it was signed
+	capped := putTestMessage(t, ours, testOwner, "capped", soon)
+	putTestMessage(t, theirs, testOwner, "capped", soon)
+	changeExpiry(theirs, capped, uint64(now.Add(maxTTL*2).Unix()), now, "capped")
+	// only they have it
+	missing := putTestMessage(t, theirs, testOwner, "missing", soon)
+	// both have it but they deleted it
+	deleted := putTestMessage(t, ours, testOwner, "deleted", soon)
+	putTestMessage(t, theirs, testOwner, "deleted", soon)
+	h, _ = hex.DecodeString(deleted)
+	_, err = theirs.DeleteMessages(testOwner, [][]byte{h}, &model.Deletion{
+		Method:   "delete",
+		Messages: []string{deleted},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ours only, stays
+	kept := putTestMessage(t, ours, testOwner, "kept", soon)
+
+	var verified []string
+	verify := func(owner string, hash []byte, del *model.Deletion) error {
+		if del == nil || del.Method != "delete" {
+			t.Errorf("tombstone for %x came without its deletion", hash)
+		}
+		verified = append(verified, hex.EncodeToString(hash))
+		return nil
+	}
+	verifyExpiry := func(owner string, hash []byte, change *model.ExpiryChange) error {
+		if change.Signature == "forged" {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	put := func(owner string, msg *model.Message) error {
+		return putMessage(ours, owner, msg)
+	}
+	s := NewSyncer(sw, testClient(), ours, put, verify, verifyExpiry)
+	s.MaxTTL = maxTTL
+	err = s.SyncWith(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(verified) != 1 || verified[0] != deleted {
+		t.Errorf("verified tombstones %v expected %s", verified, deleted)
+	}
+	expiries := make(map[string]uint64)
+	ours.IterAllFor(testOwner, func(msg model.Message) error {
+		expiries[msg.Hash] = msg.ExpirationTimestamp
+		return nil
+	})
+	if _, ok := expiries[missing]; !ok {
+		t.Error("missing message was not fetched")
+	}
+	if _, ok := expiries[deleted]; ok {
+		t.Error("deleted message was not deleted")
+	}
+	if _, ok := expiries[kept]; !ok {
+		t.Error("our own message is gone")
+	}
+	expected := []struct {
+		name      string
+		hash      string
+		expiresAt uint64
+	}{
+		{"extended", extended, later},
+		{"shortened", shortened, soon},
+		{"stale", stale, soon},
+		{"unsigned", unsigned, soon},
+		{"forged", forged, soon},
+		{"capped", capped, uint64(now.Unix()) + uint64(maxTTL/time.Second)},
+	}
+	for _, e := range expected {
+		if expiries[e.hash] != e.expiresAt {
+			t.Errorf("%s: expiration %d expected %d", e.name, expiries[e.hash], e.expiresAt)
+		}
+	}
+
+	// the messages only we have or whose expirations we kept are left to tell the buckets apart
+	h, _ = hex.DecodeString(kept)
+	err = theirs.PutTombstoneFor(testOwner, h, soon, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hash := range []string{kept, stale, unsigned, forged, capped} {
+		h, _ = hex.DecodeString(hash)
+		for _, store := range []storage.Store{ours, theirs} {
+			_, err = store.DeleteMessages(testOwner, [][]byte{h}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a, _ := ours.BucketDigests()
+	b, _ := theirs.BucketDigests()
+	if len(b) == 0 || len(a) != len(b) {
+		t.Fatalf("%d buckets after sync, they have %d", len(a), len(b))
+	}
+	for bucket, digest := range b {
+		if a[bucket] != digest {
+			t.Errorf("bucket %s differs after sync", bucket)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/replication"
+	"github.com/majestrate/swarmserv/lib/version"
+)
+
+// DefaultAdminAddr is where the admin endpoints listen by default, they are kept off the storage port
+const DefaultAdminAddr = "127.0.0.1:8081"
+
+// ServeAdmin serves the admin endpoints on l until it fails
+// whoever can connect to l can use them so it should only be reachable from this machine
+func (s *Server) ServeAdmin(l net.Listener) error {
+	return http.Serve(l, http.HandlerFunc(s.routeAdmin))
+}
+
+func (s *Server) routeAdmin(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v1/admin/stats":
+		s.handleAdminStats(w, r)
+	case "/v1/admin/storage_tests":
+		s.handleAdminStorageTests(w, r)
+	default:
+		s.plain(w, http.StatusNotFound, "not found")
+	}
+}
+
+// adminRequest checks the method of a request to an admin endpoint
+// replies with an error and returns false on fail
+func (s *Server) adminRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		s.plain(w, http.StatusNotFound, "not found")
+		return false
+	}
+	return true
+}
+
+// handleAdminStorageTests sends the storage test history of every peer we tested
+func (s *Server) handleAdminStorageTests(w http.ResponseWriter, r *http.Request) {
+	if !s.adminRequest(w, r, http.MethodGet) {
+		return
+	}
+	history := make(map[string]replication.StorageTestHistory)
+	if s.tester != nil {
+		history = s.tester.History()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"peers": history,
+	})
+}
+
+// handleAdminStats sends what we know about our swarm and how reachable our peers are
+func (s *Server) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if !s.adminRequest(w, r, http.MethodGet) {
+		return
+	}
+	stats := map[string]interface{}{
+		"version": version.Version,
+	}
+	if s.Swarm != nil {
+		if id, ok := s.Swarm.OurSwarm(); ok {
+			stats["swarm_id"] = id
+		}
+	}
+	peers := make(map[string]peer.Reachability)
+	if s.peers != nil {
+		peers = s.peers.Reachability()
+	}
+	stats["peers"] = peers
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/majestrate/swarmserv/lib/version"
+)
+
+func TestAdminListener(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.ServeAdmin(l)
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/v1/admin/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("stats got %s", resp.Status)
+	}
+	var stats struct {
+		Version string                 `json:"version"`
+		Peers   map[string]interface{} `json:"peers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Version != version.Version || stats.Peers == nil {
+		t.Errorf("got stats %+v", stats)
+	}
+
+	resp, err = http.Get("http://" + l.Addr().String() + "/v1/admin/storage_tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("storage tests got %s", resp.Status)
+	}
+
+	// the storage port does not serve them at all
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/admin/stats", nil))
+	if w.Code == http.StatusOK {
+		t.Error("stats served on the storage port")
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/majestrate/swarmserv/lib/cryptography"
+	"github.com/majestrate/swarmserv/lib/encode"
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// ErrInvalidOwnerKey is returned when a recipient's pubkey is not a hex encoded ed25519 public key
+// or is a session id without the ed25519 public key it was made from
+var ErrInvalidOwnerKey = errors.New("invalid recipient public key")
+
+// ErrBadSignature is returned when a signature does not verify
+var ErrBadSignature = errors.New("bad signature")
+
+// ErrNotPeer is returned when a request to a peer endpoint does not come from a known service node
+var ErrNotPeer = errors.New("not a known service node")
+
+// ErrPeersDisabled is returned when a peer endpoint is used but we have no service node list
+var ErrPeersDisabled = errors.New("peer endpoints disabled")
+
+// ErrStaleTimestamp is returned when a signed timestamp is outside of SignatureWindow
+var ErrStaleTimestamp = errors.New("signature timestamp out of range")
+
+// SignatureWindow is how far a signed unix timestamp may be from our clock
+const SignatureWindow = time.Minute
+
+// checkSignedTimestamp ensures a signed unix timestamp in seconds is within SignatureWindow of now
+func checkSignedTimestamp(ts string) error {
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return err
+	}
+	d := time.Since(time.Unix(t, 0))
+	if d > SignatureWindow || d < -SignatureWindow {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+// ownerSigningKey gets the ed25519 public key a recipient signs with
+// a recipient that is a hex encoded ed25519 key signs with that key
+// a session id, 05 followed by an x25519 key, signs with edkey: the hex encoded ed25519 key that converts to that x25519 key
+func ownerSigningKey(owner, edkey string) ([]byte, error) {
+	if len(owner) == 66 && strings.HasPrefix(owner, "05") {
+		x, err := cryptography.SessionIDToX25519(owner)
+		if err != nil {
+			return nil, ErrInvalidOwnerKey
+		}
+		pk, err := hex.DecodeString(edkey)
+		if err != nil || len(pk) != ed25519.PublicKeySize {
+			return nil, ErrInvalidOwnerKey
+		}
+		converted, err := cryptography.Ed25519PubKeyToX25519(pk)
+		if err != nil || !bytes.Equal(converted, x) {
+			return nil, ErrInvalidOwnerKey
+		}
+		return pk, nil
+	}
+	pk, err := hex.DecodeString(owner)
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		return nil, ErrInvalidOwnerKey
+	}
+	return pk, nil
+}
+
+// verifyOwnerSignature checks that sighex is a valid ed25519 signature over msg made by the owner's key
+// edkey is the ed25519 key of an owner that is a session id, see ownerSigningKey
+func verifyOwnerSignature(owner, edkey string, msg []byte, sighex string) error {
+	pk, err := ownerSigningKey(owner, edkey)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(sighex)
+	if err != nil || !cryptography.Verify(pk, msg, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ErrUnsignedDeletion is returned when a tombstone does not carry the recipient's signed deletion
+var ErrUnsignedDeletion = errors.New("deletion not signed by recipient")
+
+// verifyDeletion checks that a deletion kept with a tombstone for the message with hash was signed by owner
+// the signature is checked the same way replyDelete and replyDeleteAll check it, but the timestamp can be old
+// a delete_all only covers messages we have that were sent before it was signed
+// we cannot tell when a message we do not have was sent, so an old delete_all could be replayed to delete new mail
+func (s *Server) verifyDeletion(owner string, hash []byte, del *model.Deletion) error {
+	if del == nil {
+		return ErrUnsignedDeletion
+	}
+	switch del.Method {
+	case "delete":
+		signed, found := signedHashes(del.Messages, hash)
+		if !found {
+			return ErrUnsignedDeletion
+		}
+		return verifyOwnerSignature(owner, del.PubKeyEd25519, append([]byte("delete"+del.Timestamp), signed...), del.Signature)
+	case "delete_all":
+		ts, err := strconv.ParseUint(del.Timestamp, 10, 64)
+		if err != nil {
+			return err
+		}
+		msg, err := s.store.GetMessageFor(owner, hash)
+		if err != nil {
+			return err
+		}
+		if msg.Timestamp/1000 > ts {
+			// message timestamps are in milliseconds
+			return ErrUnsignedDeletion
+		}
+		return verifyOwnerSignature(owner, del.PubKeyEd25519, []byte("delete_all"+del.Timestamp), del.Signature)
+	}
+	return ErrUnsignedDeletion
+}
+
+// signedHashes concatenates the hex hashes of a signed request for checking its signature
+// also returns true if hash is one of them
+func signedHashes(messages []string, hash []byte) ([]byte, bool) {
+	hashHex := hex.EncodeToString(hash)
+	found := false
+	var signed []byte
+	for _, m := range messages {
+		found = found || strings.EqualFold(m, hashHex)
+		signed = append(signed, []byte(m)...)
+	}
+	return signed, found
+}
+
+// ErrUnsignedExpiry is returned when an expiration change does not carry the recipient's signed expire
+var ErrUnsignedExpiry = errors.New("expiry not signed by recipient")
+
+// verifyExpiryChange checks that a change of the expiration of the message with hash was signed by owner
+// the signature is checked the same way replyExpire checks it, but the timestamp can be old
+func (s *Server) verifyExpiryChange(owner string, hash []byte, change *model.ExpiryChange) error {
+	if change == nil {
+		return ErrUnsignedExpiry
+	}
+	signed, found := signedHashes(change.Messages, hash)
+	if !found {
+		return ErrUnsignedExpiry
+	}
+	return verifyOwnerSignature(owner, change.PubKeyEd25519, append([]byte("expire"+change.Expiry+change.Timestamp), signed...), change.Signature)
+}
+
+// ErrPeerBodyTooLarge is returned when a signed peer request has a body bigger than maxPeerBody
+var ErrPeerBodyTooLarge = errors.New("request body too large")
+
+// ErrReplayedSignature is returned when a signed peer request is sent again
+var ErrReplayedSignature = errors.New("signature already used")
+
+// maxPeerBody is the largest request body we read from a peer when checking its signature
+const maxPeerBody = 16 * 1024 * 1024
+
+// authenticatePeer works out which service node made a request
+// a request signed with a service node's identity key is checked against that key
+// otherwise we look up the .snode address of the remote ip
+// either way the service node must be in the service node list
+func (s *Server) authenticatePeer(r *http.Request) (swarm.ServiceNode, error) {
+	if s.Swarm == nil || s.Net == nil {
+		return swarm.ServiceNode{}, ErrPeersDisabled
+	}
+	if r.Header.Get(peer.SignatureHeader) != "" {
+		return s.authenticateSignedPeer(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	name, err := s.Net.LookupRemoteAddress(host)
+	if err != nil || !strings.HasSuffix(name, ".snode") {
+		return swarm.ServiceNode{}, ErrNotPeer
+	}
+	pk, err := encode.ZBase32Encoding.DecodeString(strings.TrimSuffix(name, ".snode"))
+	if err != nil {
+		return swarm.ServiceNode{}, ErrNotPeer
+	}
+	node, ok := s.Swarm.Lookup(hex.EncodeToString(pk))
+	if !ok {
+		return swarm.ServiceNode{}, ErrNotPeer
+	}
+	return node, nil
+}
+
+// authenticateSignedPeer checks the service node signature headers on a request
+// the body is read to check its hash and put back for the handler
+// each signature is only accepted once, they are remembered for as long as their timestamp is within SignatureWindow
+func (s *Server) authenticateSignedPeer(r *http.Request) (swarm.ServiceNode, error) {
+	pubkey := r.Header.Get(peer.PubKeyHeader)
+	node, ok := s.Swarm.Lookup(pubkey)
+	if !ok {
+		return swarm.ServiceNode{}, ErrNotPeer
+	}
+	ts := r.Header.Get(peer.TimestampHeader)
+	err := checkSignedTimestamp(ts)
+	if err != nil {
+		return swarm.ServiceNode{}, err
+	}
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(io.LimitReader(r.Body, maxPeerBody+1))
+		r.Body.Close()
+		if err != nil {
+			return swarm.ServiceNode{}, err
+		}
+		if len(body) > maxPeerBody {
+			return swarm.ServiceNode{}, ErrPeerBodyTooLarge
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	sig := r.Header.Get(peer.SignatureHeader)
+	msg := peer.SignedMessage(r.Method, r.URL.RequestURI(), ts, body)
+	err = verifyOwnerSignature(node.PubKey, "", msg, sig)
+	if err != nil {
+		return swarm.ServiceNode{}, err
+	}
+	if !s.firstUseOf(sig) {
+		return swarm.ServiceNode{}, ErrReplayedSignature
+	}
+	return node, nil
+}
+
+// firstUseOf records a peer request signature, returns false if we saw it before
+// signatures older than twice SignatureWindow are forgotten since their timestamp would be refused anyway
+func (s *Server) firstUseOf(sig string) bool {
+	s.peerSignaturesMutex.Lock()
+	defer s.peerSignaturesMutex.Unlock()
+	now := time.Now()
+	for k, seen := range s.peerSignatures {
+		if now.Sub(seen) > SignatureWindow*2 {
+			delete(s.peerSignatures, k)
+		}
+	}
+	sig = strings.ToLower(sig)
+	if _, ok := s.peerSignatures[sig]; ok {
+		return false
+	}
+	s.peerSignatures[sig] = now
+	return true
+}
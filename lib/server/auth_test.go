@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/majestrate/swarmserv/lib/cryptography"
+	"github.com/majestrate/swarmserv/lib/encode"
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// testSessionKey makes an ed25519 key pair and the session id for it
+func testSessionKey(t *testing.T) (*[ed25519.PrivateKeySize]byte, string, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := cryptography.Ed25519PubKeyToX25519(pub[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, hex.EncodeToString(pub[:]), "05" + hex.EncodeToString(x)
+}
+
+func TestOwnerSignature(t *testing.T) {
+	priv, edkey, session := testSessionKey(t)
+	_, otherEdkey, _ := testSessionKey(t)
+	sig := ed25519.Sign(priv, []byte("hello"))
+	sighex := hex.EncodeToString(sig[:])
+	tests := []struct {
+		name  string
+		owner string
+		edkey string
+		err   error
+	}{
+		{"ed25519 key", edkey, "", nil},
+		{"session id", session, edkey, nil},
+		{"session id without its ed25519 key", session, "", ErrInvalidOwnerKey},
+		{"session id with another ed25519 key", session, otherEdkey, ErrInvalidOwnerKey},
+		{"another ed25519 key", otherEdkey, "", ErrBadSignature},
+		{"not a key", "05", edkey, ErrInvalidOwnerKey},
+	}
+	for _, test := range tests {
+		err := verifyOwnerSignature(test.owner, test.edkey, []byte("hello"), sighex)
+		if err != test.err {
+			t.Errorf("%s: got %v expected %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyDeletion(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner := hex.EncodeToString(pub[:])
+	sign := func(msg string) string {
+		sig := ed25519.Sign(priv, []byte(msg))
+		return hex.EncodeToString(sig[:])
+	}
+	deletion := func(method string, msgs []string, ts, sig string) *model.Deletion {
+		return &model.Deletion{Method: method, Messages: msgs, Timestamp: ts, Signature: sig}
+	}
+	hashHex := putTestMessage(t, s, owner, "a")
+	hash, _ := hex.DecodeString(hashHex)
+	other := bytes.Repeat([]byte{1}, 32)
+	otherHex := hex.EncodeToString(other)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	before := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name string
+		hash []byte
+		del  *model.Deletion
+		ok   bool
+	}{
+		{"delete", hash, deletion("delete", []string{otherHex, hashHex}, now, sign("delete"+now+otherHex+hashHex)), true},
+		{"delete of another message", hash, deletion("delete", []string{otherHex}, now, sign("delete"+now+otherHex)), false},
+		{"delete with changed timestamp", hash, deletion("delete", []string{hashHex}, "1", sign("delete"+now+hashHex)), false},
+		{"delete_all", hash, deletion("delete_all", nil, now, sign("delete_all"+now)), true},
+		{"delete_all signed before the message was sent", hash, deletion("delete_all", nil, before, sign("delete_all"+before)), false},
+		{"delete_all of a message we do not have", other, deletion("delete_all", nil, now, sign("delete_all"+now)), false},
+		{"delete_all signed with another method", hash, deletion("delete_all", nil, now, sign("delete"+now)), false},
+		{"unknown method", hash, deletion("expire", nil, now, sign("expire"+now)), false},
+		{"unsigned", hash, nil, false},
+	}
+	for _, test := range tests {
+		err := s.verifyDeletion(owner, test.hash, test.del)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+
+}
+
+func TestVerifyExpiryChange(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	priv, edkey, owner := testSessionKey(t)
+	sign := func(msg string) string {
+		sig := ed25519.Sign(priv, []byte(msg))
+		return hex.EncodeToString(sig[:])
+	}
+	hash := bytes.Repeat([]byte{2}, 32)
+	hashHex := hex.EncodeToString(hash)
+	other := hex.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	// signed an hour ago, syncing can bring old changes
+	ts := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	expiry := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	change := func(msgs []string, expiry, sig string) *model.ExpiryChange {
+		return &model.ExpiryChange{Messages: msgs, PubKeyEd25519: edkey, Expiry: expiry, Timestamp: ts, Signature: sig}
+	}
+
+	tests := []struct {
+		name   string
+		change *model.ExpiryChange
+		ok     bool
+	}{
+		{"expire", change([]string{other, hashHex}, expiry, sign("expire"+expiry+ts+other+hashHex)), true},
+		{"expire of another message", change([]string{other}, expiry, sign("expire"+expiry+ts+other)), false},
+		{"expire with changed expiry", change([]string{hashHex}, "1", sign("expire"+expiry+ts+hashHex)), false},
+		{"expire signed with another method", change([]string{hashHex}, expiry, sign("delete"+ts+hashHex)), false},
+		{"unsigned", nil, false},
+	}
+	for _, test := range tests {
+		err := s.verifyExpiryChange(owner, hash, test.change)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+// stubResolver answers every reverse lookup with name, like a dns server reached over tcp
+func stubResolver(name string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go answerPTR(server, name)
+			return client, nil
+		},
+	}
+}
+
+// answerPTR reads one length prefixed dns query from conn and replies with a PTR record for name
+func answerPTR(conn net.Conn, name string) {
+	defer conn.Close()
+	var size [2]byte
+	_, err := io.ReadFull(conn, size[:])
+	if err != nil {
+		return
+	}
+	query := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(conn, query)
+	if err != nil || len(query) < 12 {
+		return
+	}
+	// the question is after the 12 byte header and ends with its name then 4 bytes of type and class
+	end := 12
+	for end < len(query) && query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return
+	}
+	var rdata []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		rdata = append(rdata, byte(len(label)))
+		rdata = append(rdata, label...)
+	}
+	rdata = append(rdata, 0)
+	resp := append([]byte{}, query[:2]...)
+	resp = append(resp, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0)
+	resp = append(resp, query[12:end]...)
+	// the answer points back at the name in the question, type PTR, class IN and a ttl of a minute
+	resp = append(resp, 0xc0, 12, 0, 12, 0, 1, 0, 0, 0, 60, byte(len(rdata)>>8), byte(len(rdata)))
+	resp = append(resp, rdata...)
+	binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+	conn.Write(append(size[:], resp...))
+}
+
+// testPeerServer makes a server that knows the service node with the returned key
+func testPeerServer(t *testing.T) (*Server, *[ed25519.PrivateKeySize]byte, string, func()) {
+	s, done := testServer(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		done()
+		t.Fatal(err)
+	}
+	node := swarm.ServiceNode{PubKey: hex.EncodeToString(pub[:]), Address: "127.0.0.1", Port: 1}
+	setServiceNodes(t, s, 0, node)
+	s.Net = &network.NetContext{Dialer: new(net.Dialer)}
+	return s, priv, node.PubKey, done
+}
+
+// signedPeerRequest makes a request to uri signed at ts by the service node with priv
+func signedPeerRequest(priv *[ed25519.PrivateKeySize]byte, uri string, ts time.Time, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(ts.Unix(), 10)
+	sig := ed25519.Sign(priv, peer.SignedMessage(http.MethodPost, uri, timestamp, body))
+	r.Header.Set(peer.PubKeyHeader, hex.EncodeToString(priv[32:]))
+	r.Header.Set(peer.TimestampHeader, timestamp)
+	r.Header.Set(peer.SignatureHeader, hex.EncodeToString(sig[:]))
+	return r
+}
+
+func TestAuthenticateSignedPeer(t *testing.T) {
+	s, priv, _, done := testPeerServer(t)
+	defer done()
+	_, stranger, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"pubKey":"` + testOwner + `"}`)
+	signed := signedPeerRequest(priv, "/v1/swarm/push", time.Now(), body)
+	replayed := *signed
+	w := httptest.NewRecorder()
+	if !s.authenticatedPeerRequest(w, signed, http.MethodPost) {
+		t.Fatalf("signed request got %d %s", w.Code, w.Body.String())
+	}
+	// the handler gets the body that was signed
+	got, _ := ioutil.ReadAll(signed.Body)
+	if !bytes.Equal(got, body) {
+		t.Errorf("handler got body %q after the signature was checked", got)
+	}
+	replayed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	changedBody := signedPeerRequest(priv, "/v1/swarm/push", time.Now(), body)
+	changedBody.Body = ioutil.NopCloser(strings.NewReader(`{"pubKey":""}`))
+	changedURI := signedPeerRequest(priv, "/v1/swarm/push", time.Now(), body)
+	changedURI.URL.RawQuery = "bucket=A"
+	changedURI.RequestURI += "?bucket=A"
+
+	tests := []struct {
+		name string
+		r    *http.Request
+		code int
+	}{
+		{"replayed", &replayed, http.StatusForbidden},
+		{"unknown pubkey", signedPeerRequest(stranger, "/v1/swarm/push", time.Now(), body), http.StatusForbidden},
+		{"stale timestamp", signedPeerRequest(priv, "/v1/swarm/push", time.Now().Add(-SignatureWindow*2), body), http.StatusForbidden},
+		{"changed body", changedBody, http.StatusForbidden},
+		{"changed uri", changedURI, http.StatusForbidden},
+		{"oversized body", signedPeerRequest(priv, "/v1/swarm/push", time.Now(), make([]byte, maxPeerBody+1)), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if s.authenticatedPeerRequest(w, test.r, http.MethodPost) || w.Code != test.code {
+			t.Errorf("%s: got %d %s expected %d", test.name, w.Code, w.Body.String(), test.code)
+		}
+	}
+}
+
+func TestAuthenticatePeerByAddress(t *testing.T) {
+	s, priv, pubkey, done := testPeerServer(t)
+	defer done()
+	snode := encode.ZBase32Encoding.EncodeToString(priv[32:]) + ".snode."
+	stranger := encode.ZBase32Encoding.EncodeToString(bytes.Repeat([]byte{7}, 32)) + ".snode."
+
+	tests := []struct {
+		name string
+		ptr  string
+		ok   bool
+	}{
+		{"service node", snode, true},
+		{"unknown service node", stranger, false},
+		{"not a service node", "example.com.", false},
+	}
+	for _, test := range tests {
+		s.Net.Resolver = stubResolver(test.ptr)
+		r := httptest.NewRequest(http.MethodPost, "/v1/swarm/push", nil)
+		r.RemoteAddr = "10.1.2.3:1090"
+		node, err := s.authenticatePeer(r)
+		if (err == nil) != test.ok || (test.ok && node.PubKey != pubkey) {
+			t.Errorf("%s: got %s %v", test.name, node.PubKey, err)
+		}
+	}
+}
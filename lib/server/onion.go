@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/majestrate/swarmserv/lib/cryptography"
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// OnionPath is the endpoint onion requests are sent to
+const OnionPath = "/onion_req"
+
+// maxEncryptedBody is the largest onion or encrypted storage rpc request we read
+const maxEncryptedBody = 16 * 1024 * 1024
+
+// ErrUnknownSnode is returned when an onion request is to be relayed to a service node we do not know
+var ErrUnknownSnode = errors.New("unknown service node")
+
+// bufferedResponse collects a reply so it can be sent on some other way
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{
+		header: make(http.Header),
+	}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(data)
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 {
+		b.status = code
+	}
+}
+
+// handleOnionRequest peels one layer off an onion request
+// the layer either says which service node to relay the rest to or holds a storage rpc for us to run
+// whatever comes back is encrypted to the layer's ephemeral key
+func (s *Server) handleOnionRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.plain(w, http.StatusNotFound, "not found")
+		return
+	}
+	if s.Crypto == nil {
+		s.plain(w, http.StatusServiceUnavailable, "onion requests disabled")
+		return
+	}
+	defer r.Body.Close()
+	var req model.OnionRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxEncryptedBody)).Decode(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	payload, env, err := s.decryptOnionLayer(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var hop model.OnionHop
+	err = json.Unmarshal(payload, &hop)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var inner []byte
+	if hop.Destination != "" {
+		inner, err = s.relayOnion(&hop)
+		if err != nil {
+			s.plain(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	} else {
+		inner, err = s.runOnionRPC(r.Context(), payload)
+		if err != nil {
+			s.plain(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	var out bytes.Buffer
+	err = s.Crypto.EncryptWith(env, req.EphemeralKey, bytes.NewReader(inner), &out)
+	if err != nil {
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&model.OnionResponse{
+		Ciphertext: base64.StdEncoding.EncodeToString(out.Bytes()),
+	})
+}
+
+// decryptOnionLayer decrypts the ciphertext of an onion request layer
+func (s *Server) decryptOnionLayer(req *model.OnionRequest) ([]byte, cryptography.Envelope, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(req.Ciphertext)
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.decryptFrom(req.EphemeralKey, ciphertext)
+}
+
+// decryptFrom decrypts a json payload encrypted to us by the holder of pubkey
+// returns the envelope it came in so the reply can use the same one
+func (s *Server) decryptFrom(pubkey string, ciphertext []byte) ([]byte, cryptography.Envelope, error) {
+	var payload bytes.Buffer
+	env, err := s.Crypto.DecryptFrom(pubkey, bytes.NewReader(ciphertext), &payload)
+	if err != nil {
+		return nil, env, err
+	}
+	if env == cryptography.EnvelopeCBC {
+		// drop the zero padding of the last block
+		return bytes.TrimRight(payload.Bytes(), "\x00"), env, nil
+	}
+	return payload.Bytes(), env, nil
+}
+
+// relayOnion sends the rest of an onion request to the next service node
+// returns the base64 encoded ciphertext it replied with
+func (s *Server) relayOnion(hop *model.OnionHop) ([]byte, error) {
+	if s.peers == nil {
+		return nil, ErrPeersDisabled
+	}
+	node, ok := s.Swarm.Lookup(hop.Destination)
+	if !ok {
+		return nil, ErrUnknownSnode
+	}
+	var resp model.OnionResponse
+	err := s.peers.Post(node, OnionPath, &hop.OnionRequest, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(resp.Ciphertext), nil
+}
+
+// runRPC runs a json encoded storage rpc request and collects the reply
+func (s *Server) runRPC(ctx context.Context, payload []byte) (*bufferedResponse, error) {
+	var req model.RPCRequest
+	err := json.Unmarshal(payload, &req)
+	if err != nil {
+		return nil, err
+	}
+	resp := newBufferedResponse()
+	s.dispatchRPC(ctx, resp, &req)
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp, nil
+}
+
+// runOnionRPC runs the storage rpc at the centre of an onion request
+// returns the json encoded status and body it replied with
+func (s *Server) runOnionRPC(ctx context.Context, payload []byte) ([]byte, error) {
+	resp, err := s.runRPC(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&model.OnionResult{
+		Status: resp.status,
+		Body:   resp.body.String(),
+	})
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/majestrate/swarmserv/lib/cryptography"
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// testCrypto makes a crypto context with a new identity key
+func testCrypto(t *testing.T) *cryptography.CryptoContext {
+	cc := new(cryptography.CryptoContext)
+	err := cc.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cc
+}
+
+// retrieveRPC is a storage rpc retrieving the mailbox of owner
+func retrieveRPC(owner string) []byte {
+	params, _ := json.Marshal(&model.RetrieveRequest{PubKey: owner})
+	req, _ := json.Marshal(&model.RPCRequest{
+		Method: "retrieve",
+		Params: params,
+	})
+	return req
+}
+
+// encryptTo encrypts data from cc to the service node with crypto context to
+func encryptTo(t *testing.T, cc, to *cryptography.CryptoContext, data []byte) []byte {
+	var out bytes.Buffer
+	err := cc.EncryptTo(hex.EncodeToString(to.X25519PublicKey()), bytes.NewReader(data), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// decryptFrom decrypts data to cc from the service node with crypto context from
+func decryptFrom(t *testing.T, cc, from *cryptography.CryptoContext, data []byte) []byte {
+	var out bytes.Buffer
+	_, err := cc.DecryptFrom(hex.EncodeToString(from.X25519PublicKey()), bytes.NewReader(data), &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// checkRetrieved checks a retrieve reply holds exactly the message with hash
+func checkRetrieved(t *testing.T, body []byte, hash string) {
+	var resp retrieveResponse
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatalf("bad retrieve reply %q: %s", body, err.Error())
+	}
+	if len(resp.Messages) != 1 || resp.Messages[0].Hash != hash {
+		t.Fatalf("retrieved %v expected %s", resp.Messages, hash)
+	}
+}
+
+// onionLayer encrypts payload to the service node with crypto context to using a new ephemeral key
+// returns the layer and the ephemeral key to decrypt the reply with
+func onionLayer(t *testing.T, to *cryptography.CryptoContext, payload []byte) (model.OnionRequest, *cryptography.CryptoContext) {
+	ephemeral := testCrypto(t)
+	return model.OnionRequest{
+		Ciphertext:   base64.StdEncoding.EncodeToString(encryptTo(t, ephemeral, to, payload)),
+		EphemeralKey: hex.EncodeToString(ephemeral.X25519PublicKey()),
+	}, ephemeral
+}
+
+// peelResponse decrypts one layer of an onion response
+func peelResponse(t *testing.T, ciphertext string, ephemeral, from *cryptography.CryptoContext) []byte {
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decryptFrom(t, ephemeral, from, data)
+}
+
+func TestOnionRelay(t *testing.T) {
+	// the last hop runs the rpc
+	last, done := testServer(t)
+	defer done()
+	last.Crypto = testCrypto(t)
+	hash := putTestMessage(t, last, testOwner, "hello")
+	lastSrv := httptest.NewServer(last)
+	defer lastSrv.Close()
+	host, port, _ := net.SplitHostPort(lastSrv.Listener.Addr().String())
+	lastNode := swarm.ServiceNode{
+		PubKey:  hex.EncodeToString(last.Crypto.PublicKey()),
+		Address: host,
+	}
+	lastNode.Port, _ = strconv.Atoi(port)
+
+	// the first hop knows the last one from its service node list
+	first, done := testServer(t)
+	defer done()
+	first.Crypto = testCrypto(t)
+	nodes, _ := json.Marshal([]swarm.ServiceNode{lastNode})
+	nodesFile := filepath.Join(first.root, "nodes.json")
+	err := ioutil.WriteFile(nodesFile, nodes, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Swarm = swarm.New(swarm.NewFileSource(nodesFile), hex.EncodeToString(first.Crypto.PublicKey()))
+	first.Net = &network.NetContext{Dialer: new(net.Dialer)}
+	err = first.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner, innerKey := onionLayer(t, last.Crypto, retrieveRPC(testOwner))
+	hop, _ := json.Marshal(&model.OnionHop{
+		Destination:  lastNode.PubKey,
+		OnionRequest: inner,
+	})
+	outer, outerKey := onionLayer(t, first.Crypto, hop)
+	body, _ := json.Marshal(&outer)
+	w := httptest.NewRecorder()
+	first.ServeHTTP(w, httptest.NewRequest(http.MethodPost, OnionPath, bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("onion request got %d %s", w.Code, w.Body.String())
+	}
+	var resp model.OnionResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayed := peelResponse(t, resp.Ciphertext, outerKey, first.Crypto)
+	var result model.OnionResult
+	err = json.Unmarshal(peelResponse(t, string(relayed), innerKey, last.Crypto), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Status != http.StatusOK {
+		t.Fatalf("rpc got %d %s", result.Status, result.Body)
+	}
+	checkRetrieved(t, []byte(result.Body), hash)
+
+	// a destination we do not know is not relayed
+	hop, _ = json.Marshal(&model.OnionHop{
+		Destination:  hex.EncodeToString(testCrypto(t).PublicKey()),
+		OnionRequest: inner,
+	})
+	outer, _ = onionLayer(t, first.Crypto, hop)
+	body, _ = json.Marshal(&outer)
+	w = httptest.NewRecorder()
+	first.ServeHTTP(w, httptest.NewRequest(http.MethodPost, OnionPath, bytes.NewReader(body)))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("onion request to an unknown node got %d", w.Code)
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/pow"
+	"github.com/majestrate/swarmserv/lib/replication"
+	"github.com/majestrate/swarmserv/lib/storage"
+)
+
+// ErrHashMismatch is returned when a pushed message does not have the hash it claims to have
+var ErrHashMismatch = errors.New("message hash mismatch")
+
+// handlePush stores a message another member of our swarm pushed to us
+func (s *Server) handlePush(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticatedPeerRequest(w, r, http.MethodPost) {
+		return
+	}
+	defer r.Body.Close()
+	var req model.PushRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.ensureOurSwarm(w, req.PubKey) {
+		return
+	}
+	var code int
+	if req.Tombstone != nil {
+		code, err = s.storePushedTombstone(req.PubKey, req.Tombstone)
+	} else {
+		code, err = s.storePushed(req.PubKey, &req.Message)
+	}
+	if err != nil {
+		s.plain(w, code, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+	})
+	fmt.Printf("[%s] stored pushed message\n", time.Now().String())
+}
+
+// storePushed stores a message we got from another service node
+// the proof of work is checked again so a peer cannot make up messages, the expiration is kept but capped at MaxTTL from now
+func (s *Server) storePushed(owner string, msg *model.Message) (int, error) {
+	expiration := msg.ExpirationTimestamp
+	maxExpiration := uint64(time.Now().Add(s.MaxTTL).Unix())
+	if expiration == 0 || expiration > maxExpiration {
+		expiration = maxExpiration
+	}
+	ts := strconv.FormatUint(msg.Timestamp, 10)
+	ttl := strconv.FormatUint(msg.TTL, 10)
+	if pow.MessageHash(ts, ttl, owner, msg.Data) != msg.Hash {
+		return http.StatusBadRequest, ErrHashMismatch
+	}
+	_, code, err := s.storeMessage(owner, msg.Nonce, ts, ttl, strings.NewReader(msg.Data), expiration)
+	return code, err
+}
+
+// storePushedTombstone applies a tombstone we got from another service node once we checked the recipient signed the deletion
+// the expiration is capped at MaxTTL from now like storePushed does
+func (s *Server) storePushedTombstone(owner string, e *model.SyncEntry) (int, error) {
+	hash, err := hex.DecodeString(e.Hash)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	err = s.verifyDeletion(owner, hash, e.Deletion)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+	expiration := e.ExpirationTimestamp
+	maxExpiration := uint64(time.Now().Add(s.MaxTTL).Unix())
+	if expiration == 0 || expiration > maxExpiration {
+		expiration = maxExpiration
+	}
+	err = s.store.PutTombstoneFor(owner, hash, expiration, e.Deletion)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// authenticatedPeerRequest checks the method of a request to a peer endpoint and that it comes from a service node
+// replies with an error and returns false on fail
+func (s *Server) authenticatedPeerRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		s.plain(w, http.StatusNotFound, "not found")
+		return false
+	}
+	_, err := s.authenticatePeer(r)
+	if err == ErrPeerBodyTooLarge {
+		s.plain(w, http.StatusRequestEntityTooLarge, err.Error())
+		return false
+	} else if err != nil {
+		s.plain(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
+
+// handleSyncDigests sends a digest of every storage bucket
+func (s *Server) handleSyncDigests(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticatedPeerRequest(w, r, http.MethodGet) {
+		return
+	}
+	digests, err := s.store.BucketDigests()
+	if err != nil {
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(&replication.DigestsResponse{
+		Buckets: digests,
+	})
+}
+
+// handleSyncBucket lists the messages and tombstones in a storage bucket
+func (s *Server) handleSyncBucket(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticatedPeerRequest(w, r, http.MethodGet) {
+		return
+	}
+	entries, err := s.store.BucketEntries(r.URL.Query().Get("bucket"))
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(&replication.BucketResponse{
+		Entries: entries,
+	})
+}
+
+// handleSyncFetch sends the messages a peer asked for by hash, ones we do not have are left out
+func (s *Server) handleSyncFetch(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticatedPeerRequest(w, r, http.MethodPost) {
+		return
+	}
+	defer r.Body.Close()
+	var req model.FetchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hashes, _, ok := s.decodeHashes(w, req.Messages)
+	if !ok {
+		return
+	}
+	resp := replication.FetchResponse{
+		Messages: []model.Message{},
+	}
+	for _, hash := range hashes {
+		msg, err := s.store.GetMessageFor(req.PubKey, hash)
+		if err == storage.ErrNoSuchMessage {
+			continue
+		} else if err != nil {
+			s.plain(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		msg.Seq = 0
+		resp.Messages = append(resp.Messages, *msg)
+	}
+	json.NewEncoder(w).Encode(&resp)
+}
+
+// handleStorageTest answers a storage test challenge from a peer by sending the message it asked for
+func (s *Server) handleStorageTest(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticatedPeerRequest(w, r, http.MethodPost) {
+		return
+	}
+	defer r.Body.Close()
+	var req model.StorageTestRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	hash, err := hex.DecodeString(req.Hash)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.ensureOurSwarm(w, req.PubKey) {
+		return
+	}
+	msg, err := s.store.GetMessageFor(req.PubKey, hash)
+	if err == storage.ErrNoSuchMessage {
+		s.plain(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	msg.Seq = 0
+	json.NewEncoder(w).Encode(msg)
+}
+
+// putSynced stores a message pulled from a peer during sync
+func (s *Server) putSynced(owner string, msg *model.Message) error {
+	_, err := s.storePushed(owner, msg)
+	if err == ErrDuplicateHash {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// SenderKeyHeader holds the hex encoded x25519 key a storage rpc body is encrypted with, the reply is encrypted to it too
+const SenderKeyHeader = "X-Sender-Public-Key"
+
+func (s *Server) handleV1StoreRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.plain(w, http.StatusNotFound, "not found")
+		return
+	}
+	defer r.Body.Close()
+	if r.Header.Get(SenderKeyHeader) != "" {
+		s.handleEncryptedRPC(w, r)
+		return
+	}
+	var req model.RPCRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.dispatchRPC(r.Context(), w, &req)
+}
+
+// handleEncryptedRPC runs a storage rpc with a body encrypted to us by the key in SenderKeyHeader
+// the reply body is encrypted back to that key so proxies in between cannot read either
+func (s *Server) handleEncryptedRPC(w http.ResponseWriter, r *http.Request) {
+	if s.Crypto == nil {
+		s.plain(w, http.StatusServiceUnavailable, "encrypted requests disabled")
+		return
+	}
+	sender := r.Header.Get(SenderKeyHeader)
+	ciphertext, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEncryptedBody))
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	payload, env, err := s.decryptFrom(sender, ciphertext)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	resp, err := s.runRPC(r.Context(), payload)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var out bytes.Buffer
+	err = s.Crypto.EncryptWith(env, sender, &resp.body, &out)
+	if err != nil {
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+	w.WriteHeader(resp.status)
+	w.Write(out.Bytes())
+}
+
+// dispatchRPC runs a storage rpc request and writes the result to w
+func (s *Server) dispatchRPC(ctx context.Context, w http.ResponseWriter, req *model.RPCRequest) {
+	switch req.Method {
+	case "store":
+		var params model.StoreRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyStore(w, params.PubKey, params.Nonce, params.Timestamp, params.TTL, strings.NewReader(params.Data))
+		}
+	case "retrieve":
+		var params model.RetrieveRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyRetrieve(ctx, w, &params)
+		}
+	case "delete":
+		var params model.DeleteRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyDelete(w, &params)
+		}
+	case "delete_all":
+		var params model.DeleteAllRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyDeleteAll(w, &params)
+		}
+	case "expire":
+		var params model.ExpireRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyExpire(w, &params)
+		}
+	case "get_snodes_for_pubkey":
+		var params model.GetSnodesRequest
+		if s.decodeParams(w, req, &params) {
+			s.replyGetSnodes(w, params.PubKey)
+		}
+	default:
+		s.plain(w, http.StatusBadRequest, "invalid method: "+req.Method)
+	}
+}
+
+// decodeParams decodes the params of req into v, replies with an error and returns false on fail
+func (s *Server) decodeParams(w http.ResponseWriter, req *model.RPCRequest, v interface{}) bool {
+	if len(req.Params) == 0 {
+		s.plain(w, http.StatusBadRequest, "no params provided")
+		return false
+	}
+	err := json.Unmarshal(req.Params, v)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, "invalid params: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// replyDelete deletes messages for a recipient after checking the recipient's signature
+func (s *Server) replyDelete(w http.ResponseWriter, req *model.DeleteRequest) {
+	hashes, signed, ok := s.decodeHashes(w, req.Messages)
+	if !ok {
+		return
+	}
+	err := checkSignedTimestamp(req.Timestamp)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = verifyOwnerSignature(req.PubKey, req.PubKeyEd25519, append([]byte("delete"+req.Timestamp), signed...), req.Signature)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	deleted, err := s.store.DeleteMessages(req.PubKey, hashes, &model.Deletion{
+		Method:        "delete",
+		Messages:      req.Messages,
+		PubKeyEd25519: req.PubKeyEd25519,
+		Timestamp:     req.Timestamp,
+		Signature:     req.Signature,
+	})
+	if err != nil {
+		fmt.Printf("[%s] error deleting messages: %s\n", time.Now().String(), err.Error())
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": hexHashes(deleted),
+	})
+}
+
+// replyDeleteAll wipes all messages for a recipient after checking the recipient's signature
+// the deleted messages leave tombstones until they expire so they cannot be stored or synced again
+func (s *Server) replyDeleteAll(w http.ResponseWriter, req *model.DeleteAllRequest) {
+	err := checkSignedTimestamp(req.Timestamp)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = verifyOwnerSignature(req.PubKey, req.PubKeyEd25519, []byte("delete_all"+req.Timestamp), req.Signature)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	deleted, err := s.store.DeleteAllFor(req.PubKey, &model.Deletion{
+		Method:        "delete_all",
+		PubKeyEd25519: req.PubKeyEd25519,
+		Timestamp:     req.Timestamp,
+		Signature:     req.Signature,
+	})
+	if err != nil {
+		fmt.Printf("[%s] error deleting all messages: %s\n", time.Now().String(), err.Error())
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"count":   len(deleted),
+		"deleted": hexHashes(deleted),
+	})
+}
+
+// replyExpire changes the expiration of messages for a recipient after checking the recipient's signature
+// extending the expiration is capped at MaxTTL from when the request was signed
+// the signed request is kept with the messages so other service nodes can apply it too
+func (s *Server) replyExpire(w http.ResponseWriter, req *model.ExpireRequest) {
+	expiry, err := strconv.ParseUint(req.Expiry, 10, 64)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, "invalid expiry: "+err.Error())
+		return
+	}
+	hashes, signed, ok := s.decodeHashes(w, req.Messages)
+	if !ok {
+		return
+	}
+	err = checkSignedTimestamp(req.Timestamp)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	err = verifyOwnerSignature(req.PubKey, req.PubKeyEd25519, append([]byte("expire"+req.Expiry+req.Timestamp), signed...), req.Signature)
+	if err != nil {
+		s.plain(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	// capped from when it was signed so every service node caps it the same
+	ts, _ := strconv.ParseUint(req.Timestamp, 10, 64)
+	maxExpiry := ts + uint64(s.MaxTTL/time.Second)
+	if expiry > maxExpiry {
+		expiry = maxExpiry
+	}
+	updated, err := s.store.UpdateExpiry(req.PubKey, hashes, expiry, &model.ExpiryChange{
+		Messages:      req.Messages,
+		PubKeyEd25519: req.PubKeyEd25519,
+		Expiry:        req.Expiry,
+		Timestamp:     req.Timestamp,
+		Signature:     req.Signature,
+	})
+	if err != nil {
+		fmt.Printf("[%s] error updating expiry: %s\n", time.Now().String(), err.Error())
+		s.plain(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"expiry":  expiry,
+		"updated": hexHashes(updated),
+	})
+}
+
+// decodeHashes decodes a list of hex message hashes, also returns the hashes concatenated for signing
+// replies with an error and returns false on fail
+func (s *Server) decodeHashes(w http.ResponseWriter, strs []string) ([][]byte, []byte, bool) {
+	var hashes [][]byte
+	var signed []byte
+	for _, m := range strs {
+		h, err := hex.DecodeString(m)
+		if err != nil || len(h) == 0 {
+			s.plain(w, http.StatusBadRequest, "invalid message hash: "+m)
+			return nil, nil, false
+		}
+		hashes = append(hashes, h)
+		signed = append(signed, []byte(m)...)
+	}
+	return hashes, signed, true
+}
+
+// hexHashes hex encodes a list of message hashes
+func hexHashes(hashes [][]byte) []string {
+	strs := []string{}
+	for _, h := range hashes {
+		strs = append(strs, hex.EncodeToString(h))
+	}
+	return strs
+}
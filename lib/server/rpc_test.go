@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/agl/ed25519"
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/pow"
+)
+
+// storageRPC runs a storage rpc with a json body, returns the reply
+func storageRPC(s *Server, method string, params interface{}) *httptest.ResponseRecorder {
+	p, _ := json.Marshal(params)
+	body, _ := json.Marshal(&model.RPCRequest{
+		Method: method,
+		Params: p,
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/storage_rpc", bytes.NewReader(body)))
+	return w
+}
+
+// ownerSign makes a recipient's hex encoded signature over msg
+func ownerSign(priv *[ed25519.PrivateKeySize]byte, msg string) string {
+	sig := ed25519.Sign(priv, []byte(msg))
+	return hex.EncodeToString(sig[:])
+}
+
+// solvePoW finds a nonce for a message that passes the proof of work
+func solvePoW(t *testing.T, ts, ttl, owner, data string) string {
+	var nonce [8]byte
+	for i := uint64(0); i < 1<<20; i++ {
+		binary.BigEndian.PutUint64(nonce[:], i)
+		n := base64.StdEncoding.EncodeToString(nonce[:])
+		_, err := pow.CheckPOW(n, ts, ttl, owner, strings.NewReader(data))
+		if err == nil {
+			return n
+		}
+	}
+	t.Fatal("no nonce found")
+	return ""
+}
+
+func TestEncryptedRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.Crypto = testCrypto(t)
+	hash := putTestMessage(t, s, testOwner, "hello")
+	client := testCrypto(t)
+
+	body := encryptTo(t, client, s.Crypto, retrieveRPC(testOwner))
+	r := httptest.NewRequest(http.MethodPost, "/v1/storage_rpc", bytes.NewReader(body))
+	r.Header.Set(SenderKeyHeader, hex.EncodeToString(client.X25519PublicKey()))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("encrypted retrieve got %d %s", w.Code, w.Body.String())
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("hello")) {
+		t.Fatal("reply is not encrypted")
+	}
+	checkRetrieved(t, decryptFrom(t, client, s.Crypto, w.Body.Bytes()), hash)
+
+	// a body not encrypted to us is refused
+	body = encryptTo(t, client, testCrypto(t), retrieveRPC(testOwner))
+	r = httptest.NewRequest(http.MethodPost, "/v1/storage_rpc", bytes.NewReader(body))
+	r.Header.Set(SenderKeyHeader, hex.EncodeToString(client.X25519PublicKey()))
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrongly encrypted retrieve got %d", w.Code)
+	}
+}
+
+func TestStoreAndRetrieveRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	ts := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+	store := &model.StoreRequest{
+		PubKey:    testOwner,
+		TTL:       "3600",
+		Timestamp: ts,
+		Data:      "hello",
+	}
+	store.Nonce = solvePoW(t, ts, store.TTL, testOwner, store.Data)
+	hash := pow.MessageHash(ts, store.TTL, testOwner, store.Data)
+
+	w := storageRPC(s, "store", store)
+	if w.Code != http.StatusOK {
+		t.Fatalf("store got %d %s", w.Code, w.Body.String())
+	}
+	w = storageRPC(s, "store", store)
+	if w.Code != http.StatusConflict {
+		t.Errorf("storing again got %d %s", w.Code, w.Body.String())
+	}
+	badPoW := *store
+	badPoW.Data = "changed"
+	badPoW.Nonce = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xff}, 8))
+	w = storageRPC(s, "store", &badPoW)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("store with the wrong nonce got %d %s", w.Code, w.Body.String())
+	}
+
+	w = storageRPC(s, "retrieve", &model.RetrieveRequest{PubKey: testOwner})
+	if w.Code != http.StatusOK {
+		t.Fatalf("retrieve got %d %s", w.Code, w.Body.String())
+	}
+	checkRetrieved(t, w.Body.Bytes(), hash)
+
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/storage_rpc", strings.NewReader(`{"method":"retrieve"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("retrieve without params got %d", w.Code)
+	}
+	w = storageRPC(s, "stored", store)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown method got %d", w.Code)
+	}
+}
+
+func TestDeleteRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	priv, edkey, owner := testSessionKey(t)
+	_, otherKey, _ := testSessionKey(t)
+	hash := putTestMessage(t, s, owner, "hello")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-SignatureWindow*2).Unix(), 10)
+	del := func(edkey, ts, sig string) *model.DeleteRequest {
+		return &model.DeleteRequest{PubKey: owner, PubKeyEd25519: edkey, Messages: []string{hash}, Timestamp: ts, Signature: sig}
+	}
+
+	tests := []struct {
+		name string
+		req  *model.DeleteRequest
+	}{
+		{"bad signature", del(edkey, now, ownerSign(priv, "delete"+stale+hash))},
+		{"stale timestamp", del(edkey, stale, ownerSign(priv, "delete"+stale+hash))},
+		{"another ed25519 key", del(otherKey, now, ownerSign(priv, "delete"+now+hash))},
+	}
+	for _, test := range tests {
+		w := storageRPC(s, "delete", test.req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d %s", test.name, w.Code, w.Body.String())
+		}
+	}
+	checkRetrieved(t, storageRPC(s, "retrieve", &model.RetrieveRequest{PubKey: owner}).Body.Bytes(), hash)
+
+	w := storageRPC(s, "delete", del(edkey, now, ownerSign(priv, "delete"+now+hash)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Deleted []string `json:"deleted"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if len(resp.Deleted) != 1 || resp.Deleted[0] != hash {
+		t.Errorf("deleted %v expected %s", resp.Deleted, hash)
+	}
+	h, _ := hex.DecodeString(hash)
+	_, err := s.store.GetMessageFor(owner, h)
+	if err == nil {
+		t.Error("message still stored after delete")
+	}
+}
+
+func TestDeleteAllRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	priv, edkey, owner := testSessionKey(t)
+	putTestMessage(t, s, owner, "one")
+	putTestMessage(t, s, owner, "two")
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-SignatureWindow*2).Unix(), 10)
+	deleteAll := func(ts, sig string) *model.DeleteAllRequest {
+		return &model.DeleteAllRequest{PubKey: owner, PubKeyEd25519: edkey, Timestamp: ts, Signature: sig}
+	}
+
+	tests := []struct {
+		name string
+		req  *model.DeleteAllRequest
+	}{
+		{"bad signature", deleteAll(now, ownerSign(priv, "delete_all"+stale))},
+		{"signed with another method", deleteAll(now, ownerSign(priv, "delete"+now))},
+		{"stale timestamp", deleteAll(stale, ownerSign(priv, "delete_all"+stale))},
+	}
+	for _, test := range tests {
+		w := storageRPC(s, "delete_all", test.req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d %s", test.name, w.Code, w.Body.String())
+		}
+	}
+
+	w := storageRPC(s, "delete_all", deleteAll(now, ownerSign(priv, "delete_all"+now)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete_all got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Count int `json:"count"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Count != 2 {
+		t.Errorf("deleted %d messages expected 2", resp.Count)
+	}
+	tombstones, _ := s.store.TombstonesFor(owner)
+	if len(tombstones) != 2 {
+		t.Errorf("%d tombstones after delete_all expected 2", len(tombstones))
+	}
+}
+
+func TestExpireRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.MaxTTL = time.Hour
+	priv, edkey, owner := testSessionKey(t)
+	hash := putTestMessage(t, s, owner, "hello")
+	signedAt := time.Now()
+	now := strconv.FormatInt(signedAt.Unix(), 10)
+	stale := strconv.FormatInt(signedAt.Add(-SignatureWindow*2).Unix(), 10)
+	soon := strconv.FormatInt(signedAt.Add(time.Minute*10).Unix(), 10)
+	tooLate := strconv.FormatInt(signedAt.Add(time.Hour*10).Unix(), 10)
+	expire := func(expiry, ts, sig string) *model.ExpireRequest {
+		return &model.ExpireRequest{PubKey: owner, PubKeyEd25519: edkey, Messages: []string{hash}, Expiry: expiry, Timestamp: ts, Signature: sig}
+	}
+
+	tests := []struct {
+		name string
+		req  *model.ExpireRequest
+	}{
+		{"bad signature", expire(soon, now, ownerSign(priv, "expire"+tooLate+now+hash))},
+		{"stale timestamp", expire(soon, stale, ownerSign(priv, "expire"+soon+stale+hash))},
+	}
+	for _, test := range tests {
+		w := storageRPC(s, "expire", test.req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d %s", test.name, w.Code, w.Body.String())
+		}
+	}
+
+	h, _ := hex.DecodeString(hash)
+	expected := []struct {
+		name   string
+		expiry string
+		capped uint64
+	}{
+		{"shortened", soon, uint64(signedAt.Add(time.Minute * 10).Unix())},
+		{"extended past MaxTTL", tooLate, uint64(signedAt.Add(time.Hour).Unix())},
+	}
+	for _, e := range expected {
+		w := storageRPC(s, "expire", expire(e.expiry, now, ownerSign(priv, "expire"+e.expiry+now+hash)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expire got %d %s", e.name, w.Code, w.Body.String())
+		}
+		var resp struct {
+			Expiry  uint64   `json:"expiry"`
+			Updated []string `json:"updated"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Expiry != e.capped || len(resp.Updated) != 1 || resp.Updated[0] != hash {
+			t.Errorf("%s: got %+v expected expiry %d for %s", e.name, resp, e.capped, hash)
+		}
+		msg, err := s.store.GetMessageFor(owner, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.ExpirationTimestamp != e.capped {
+			t.Errorf("%s: stored expiration %d expected %d", e.name, msg.ExpirationTimestamp, e.capped)
+		}
+	}
+}
@@ -1,31 +1,131 @@
 package server
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/majestrate/swarmserv/lib/cryptography"
 	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/notify"
+	"github.com/majestrate/swarmserv/lib/peer"
 	"github.com/majestrate/swarmserv/lib/pow"
+	"github.com/majestrate/swarmserv/lib/replication"
 	"github.com/majestrate/swarmserv/lib/storage"
+	"github.com/majestrate/swarmserv/lib/swarm"
 )
 
+// DefaultMaxTTL is the default for Server.MaxTTL
+const DefaultMaxTTL = time.Hour * 96
+
+// DefaultLongPollTimeout is the default for Server.LongPollTimeout
+const DefaultLongPollTimeout = time.Second * 20
+
+// swarmUpdateInterval is how often we reload the service node list
+const swarmUpdateInterval = time.Minute
+
+// DefaultRetrieveLimit is the default for Server.RetrieveLimit
+const DefaultRetrieveLimit = 256
+
+// DefaultRetrieveMaxBytes is the default for Server.RetrieveMaxBytes
+const DefaultRetrieveMaxBytes = 1024 * 1024 * 4
+
 type Server struct {
-	store storage.Store
+	// MaxTTL is how far into the future a recipient may extend the expiration of a message
+	MaxTTL time.Duration
+	// LongPollTimeout is how long a long polling retrieve waits for new messages
+	LongPollTimeout time.Duration
+	// MaxSubscriptionsPerIP is how many concurrent mailbox subscriptions one remote ip may have open
+	MaxSubscriptionsPerIP int
+	// RetrieveLimit is the most messages sent in one retrieve
+	RetrieveLimit int
+	// RetrieveMaxBytes is the most bytes of message data sent in one retrieve
+	RetrieveMaxBytes int
+	// Swarm is our view of the service node list, nil if we do not have one
+	Swarm *swarm.Swarm
+	// Net is used to talk to other service nodes, peer endpoints are disabled if it or Swarm is nil
+	Net *network.NetContext
+	// Crypto decrypts onion requests to us, onion requests are disabled if it is nil
+	Crypto *cryptography.CryptoContext
+	// Signer signs our requests to other service nodes with our identity key, requests are unsigned if it is nil
+	Signer peer.Signer
+	// SignResponses signs every reply except subscription streams with Signer
+	SignResponses bool
+
+	root               string
+	store              storage.Store
+	peers              *peer.Client
+	replicator         *replication.Replicator
+	syncer             *replication.Syncer
+	handoff            *replication.Handoff
+	tester             *replication.StorageTester
+	hub                *notify.Hub
+	subscriptions      map[string]int
+	subscriptionsMutex sync.Mutex
+	// peer request signatures seen recently, see firstUseOf
+	peerSignatures      map[string]time.Time
+	peerSignaturesMutex sync.Mutex
 }
 
 func NewServer(storedir string) *Server {
 	return &Server{
-		store: storage.NewSkiplistStore(storedir),
+		MaxTTL:                DefaultMaxTTL,
+		LongPollTimeout:       DefaultLongPollTimeout,
+		MaxSubscriptionsPerIP: DefaultMaxSubscriptionsPerIP,
+		RetrieveLimit:         DefaultRetrieveLimit,
+		RetrieveMaxBytes:      DefaultRetrieveMaxBytes,
+		root:                  storedir,
+		store:                 storage.NewSkiplistStore(storedir),
+		hub:                   notify.NewHub(),
+		subscriptions:         make(map[string]int),
+		peerSignatures:        make(map[string]time.Time),
 	}
 }
 
 func (s *Server) Init() error {
-	return s.store.Init()
+	err := s.store.Init()
+	if err != nil {
+		return err
+	}
+	if s.Swarm != nil {
+		err = s.Swarm.Update()
+		if err != nil {
+			// not fatal, we retry on tick
+			fmt.Printf("!!! [%s] error loading service node list: %s\n", time.Now().String(), err.Error())
+		}
+	}
+	if s.Swarm != nil && s.Net != nil {
+		s.peers = peer.NewClient(s.Net, s.Signer)
+		go s.peers.RunProber(s.Swarm)
+		s.replicator = replication.NewReplicator(s.root, s.Swarm, s.peers, s.store)
+		err = s.replicator.Init()
+		if err != nil {
+			return err
+		}
+		go s.replicator.Run()
+		s.syncer = replication.NewSyncer(s.Swarm, s.peers, s.store, s.putSynced, s.verifyDeletion, s.verifyExpiryChange)
+		s.syncer.MaxTTL = s.MaxTTL
+		go s.syncer.Run()
+		s.handoff = replication.NewHandoff(s.root, s.Swarm, s.peers, s.store)
+		err = s.handoff.Init()
+		if err != nil {
+			return err
+		}
+		go s.handoff.Run()
+		s.tester = replication.NewStorageTester(s.Swarm, s.peers, s.store)
+		go s.tester.Run()
+	}
+	return nil
 }
 
 func (s *Server) Tick() {
@@ -33,10 +133,43 @@ func (s *Server) Tick() {
 	if err != nil {
 		fmt.Printf("!!! [%s] error during expiration: %s\n", time.Now().String(), err.Error())
 	}
+	if s.Swarm != nil {
+		err = s.Swarm.UpdateIfOlderThan(swarmUpdateInterval)
+		if err != nil {
+			fmt.Printf("!!! [%s] error updating service node list: %s\n", time.Now().String(), err.Error())
+		}
+	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// subscriptions stream so they cannot be held back to be signed
+	if s.SignResponses && s.Signer != nil && r.URL.Path != "/v1/subscribe" {
+		resp := newBufferedResponse()
+		s.route(resp, r)
+		s.writeSigned(w, r, resp)
+		return
+	}
+	s.route(w, r)
+}
+
+// writeSigned sends a collected reply to r with our signature over it
+func (s *Server) writeSigned(w http.ResponseWriter, r *http.Request, resp *bufferedResponse) {
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	if w.Header().Get("Content-Type") == "" {
+		// set it now like net/http would so it is covered by the signature
+		w.Header().Set("Content-Type", http.DetectContentType(resp.body.Bytes()))
+	}
+	peer.SignResponse(s.Signer, r, resp.status, w.Header(), resp.body.Bytes())
+	w.WriteHeader(resp.status)
+	w.Write(resp.body.Bytes())
+}
 
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case "/store":
 		s.handleStore(w, r)
@@ -44,18 +177,25 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleRetrieve(w, r)
 	case "/v1/storage_rpc":
 		s.handleV1StoreRPC(w, r)
+	case "/v1/subscribe":
+		s.handleSubscribe(w, r)
+	case OnionPath:
+		s.handleOnionRequest(w, r)
+	case replication.PushPath:
+		s.handlePush(w, r)
+	case replication.DigestsPath:
+		s.handleSyncDigests(w, r)
+	case replication.BucketPath:
+		s.handleSyncBucket(w, r)
+	case replication.FetchPath:
+		s.handleSyncFetch(w, r)
+	case replication.StorageTestPath:
+		s.handleStorageTest(w, r)
 	default:
 		w.WriteHeader(http.StatusBadRequest)
 	}
 }
 
-func (s *Server) handleV1StoreRPC(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		s.plain(w, http.StatusNotFound, "not found")
-		return
-	}
-}
-
 func (s *Server) plain(w http.ResponseWriter, code int, msg string) {
 	fmt.Printf("%d %s\n", code, msg)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(msg)))
@@ -64,71 +204,189 @@ func (s *Server) plain(w http.ResponseWriter, code int, msg string) {
 	io.WriteString(w, msg)
 }
 
+// ErrDuplicateHash is returned when storing a message we already have
+var ErrDuplicateHash = errors.New("duplicate hash")
+
 func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) {
-	tmpfilename := s.store.Mktemp()
 	defer r.Body.Close()
 	nonce := r.Header.Get("X-Loki-pow-nonce")
 	ttl := r.Header.Get("X-Loki-ttl")
 	ts := r.Header.Get("X-Loki-timestamp")
 	recip := r.Header.Get("X-Loki-recipient")
-	f, err := os.OpenFile(tmpfilename, os.O_CREATE|os.O_WRONLY, 0600)
+	s.replyStore(w, recip, nonce, ts, ttl, r.Body)
+}
+
+// replyStore checks the proof of work on body and stores it for recip
+// recipients outside of our swarm are told which swarm to use instead
+func (s *Server) replyStore(w http.ResponseWriter, recip, nonce, ts, ttl string, body io.Reader) {
+	if !s.ensureOurSwarm(w, recip) {
+		return
+	}
+	msg, code, err := s.storeMessage(recip, nonce, ts, ttl, body, 0)
 	if err != nil {
-		s.plain(w, http.StatusInternalServerError, err.Error())
+		s.plain(w, code, err.Error())
 		return
 	}
+	if s.replicator != nil {
+		err = s.replicator.Enqueue(recip, msg.Hash)
+		if err != nil {
+			fmt.Printf("!!! [%s] failed to queue message for replication: %s\n", time.Now().String(), err.Error())
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "ok",
+	})
+	fmt.Printf("[%s] stored message\n", time.Now().String())
+}
+
+// storeMessage checks the proof of work on a message body and stores it for recip
+// if expiration is not 0 it is used instead of the expiration worked out from ttl
+// returns the stored message, the http status code to reply with and an error on fail
+func (s *Server) storeMessage(recip, nonce, ts, ttl string, body io.Reader, expiration uint64) (*model.Message, int, error) {
+	tmpfilename := s.store.Mktemp()
+	f, err := os.OpenFile(tmpfilename, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
 	pr, pw := io.Pipe()
 	mw := io.MultiWriter(pw, f)
+	done := make(chan struct{})
 	go func() {
 		var buf [65536]byte
-		io.CopyBuffer(mw, r.Body, buf[:])
+		io.CopyBuffer(mw, body, buf[:])
 		pw.Close()
 		f.Close()
+		close(done)
 	}()
 	h, err := pow.CheckPOW(nonce, ts, ttl, recip, pr)
+	// drain so the temp file is fully written before we move it
+	io.Copy(ioutil.Discard, pr)
+	<-done
 	if err != nil {
 		os.Remove(tmpfilename)
-		s.plain(w, http.StatusForbidden, err.Error())
-		return
+		return nil, http.StatusForbidden, err
+	}
+	if expiration != 0 {
+		h.ExpirationTimestamp = expiration
 	}
 	ok, err := s.store.PutMessageFor(recip, h, tmpfilename)
 	if ok {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status": "ok",
-		})
-		fmt.Printf("[%s] stored message\n", time.Now().String())
-	} else {
-		os.Remove(tmpfilename)
-		if err == nil {
-			s.plain(w, http.StatusConflict, "duplicate hash")
-		} else {
-			s.plain(w, http.StatusInternalServerError, err.Error())
-		}
+		s.hub.Notify(recip)
+		return h, http.StatusOK, nil
+	}
+	os.Remove(tmpfilename)
+	if err == nil {
+		return nil, http.StatusConflict, ErrDuplicateHash
 	}
+	return nil, http.StatusInternalServerError, err
 }
 
 func (s *Server) handleRetrieve(w http.ResponseWriter, r *http.Request) {
+	req := model.RetrieveRequest{
+		PubKey:   r.Header.Get("X-Loki-recipient"),
+		LastHash: r.Header.Get("X-Loki-last-hash"),
+		Cursor:   r.Header.Get("X-Loki-cursor"),
+	}
+	req.LongPoll, _ = strconv.ParseBool(r.Header.Get("X-Loki-long-poll"))
+	req.Limit, _ = strconv.Atoi(r.Header.Get("X-Loki-limit"))
+	req.MaxBytes, _ = strconv.Atoi(r.Header.Get("X-Loki-max-bytes"))
+	s.replyRetrieve(r.Context(), w, &req)
+}
 
+// replyRetrieve sends a page of messages for a recipient stored after the request's cursor or last hash
+// if LongPoll is set and there are no messages we wait up to LongPollTimeout for one to arrive
+func (s *Server) replyRetrieve(ctx context.Context, w http.ResponseWriter, req *model.RetrieveRequest) {
+	var wakeup chan struct{}
+	if req.LongPoll {
+		// subscribe before looking so we cannot miss a message stored in between
+		wakeup = s.hub.Subscribe(req.PubKey)
+		defer s.hub.Unsubscribe(req.PubKey, wakeup)
+	}
+	limit, maxBytes := s.retrieveLimits(req.Limit, req.MaxBytes)
+	seq, err := s.resolveCursor(req.PubKey, req.LastHash, req.Cursor)
 	var msgs []model.Message
-
-	lastHash, _ := hex.DecodeString(r.Header.Get("X-Loki-last-hash"))
-	owner := r.Header.Get("X-Loki-recipient")
-	lastExpire := uint64(0)
-
-	err := s.store.IterSinceHashFor(owner, lastHash, func(m model.Message) error {
-		msgs = append(msgs, m)
-		if lastExpire < m.ExpirationTimestamp {
-			lastExpire = m.ExpirationTimestamp
-			lastHash, _ = hex.DecodeString(m.Hash)
+	more := false
+	if err == nil {
+		msgs, seq, more, err = s.retrieveMessages(req.PubKey, seq, limit, maxBytes)
+	}
+	if err == nil && len(msgs) == 0 && req.LongPoll {
+		timer := time.NewTimer(s.LongPollTimeout)
+		defer timer.Stop()
+		select {
+		case <-wakeup:
+			msgs, seq, more, err = s.retrieveMessages(req.PubKey, seq, limit, maxBytes)
+		case <-timer.C:
+		case <-ctx.Done():
 		}
-		return nil
-	})
+	}
 	if err != nil {
 		fmt.Printf("[%s] error retrieving messages: %s\n", time.Now().String(), err.Error())
 		s.plain(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	lastHash := req.LastHash
+	if len(msgs) > 0 {
+		lastHash = msgs[len(msgs)-1].Hash
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"messages": msgs,
-		"lastHash": hex.EncodeToString(lastHash),
+		"lastHash": lastHash,
+		"cursor":   strconv.FormatUint(seq, 10),
+		"more":     more,
 	})
 }
+
+// retrieveLimits caps the limits a client asked for to our own, 0 means no preference
+func (s *Server) retrieveLimits(limit, maxBytes int) (int, int) {
+	if limit <= 0 || limit > s.RetrieveLimit {
+		limit = s.RetrieveLimit
+	}
+	if maxBytes <= 0 || maxBytes > s.RetrieveMaxBytes {
+		maxBytes = s.RetrieveMaxBytes
+	}
+	return limit, maxBytes
+}
+
+// resolveCursor gets the sequence number to resume retrieving from, cursor takes precedence over lastHashHex
+// a last hash we do not have resumes from the start of the mailbox
+func (s *Server) resolveCursor(owner, lastHashHex, cursor string) (uint64, error) {
+	if cursor != "" {
+		seq, err := strconv.ParseUint(cursor, 10, 64)
+		if err == nil {
+			return seq, nil
+		}
+	}
+	lastHash, _ := hex.DecodeString(lastHashHex)
+	if len(lastHash) == 0 {
+		return 0, nil
+	}
+	seq, err := s.store.LookupSeqFor(owner, lastHash)
+	if err == storage.ErrUnknownCursor {
+		return 0, nil
+	}
+	return seq, err
+}
+
+// retrieveMessages loads up to limit messages for owner stored after sequence number seq in order
+// stops before the data of the loaded messages would go over maxBytes but always loads at least one message
+// an unknown sequence number loads from the start of the mailbox
+// returns the messages, the sequence number to resume from and true if there are more messages after them
+func (s *Server) retrieveMessages(owner string, seq uint64, limit, maxBytes int) ([]model.Message, uint64, bool, error) {
+
+	var msgs []model.Message
+
+	next := seq
+	visit := func(m model.Message) error {
+		msgs = append(msgs, m)
+		if m.Seq > next {
+			next = m.Seq
+		}
+		return nil
+	}
+	more, err := s.store.IterPageSinceSeqFor(owner, seq, limit, maxBytes, visit)
+	if err == storage.ErrUnknownCursor {
+		next = 0
+		more, err = s.store.IterPageSinceSeqFor(owner, 0, limit, maxBytes, visit)
+	}
+	return msgs, next, more, err
+}
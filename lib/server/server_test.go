@@ -0,0 +1,218 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/network"
+	"github.com/majestrate/swarmserv/lib/peer"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+const testOwner = "0500000000000000000000000000000000000000000000000000000000000000ff"
+
+// testServer makes a server storing in a new temp dir, call the returned func to remove it
+func testServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "swarmserv-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(dir)
+	err = s.Init()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// putTestMessage stores data for owner the way storeMessage does without the proof of work, returns its hex hash
+func putTestMessage(t *testing.T, s *Server, owner, data string) string {
+	h := sha256.Sum256([]byte(owner + data))
+	fname := s.store.Mktemp()
+	err := ioutil.WriteFile(fname, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &model.Message{
+		Hash:                hex.EncodeToString(h[:]),
+		Timestamp:           uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		ExpirationTimestamp: uint64(time.Now().Add(time.Hour).Unix()),
+		Data:                data,
+	}
+	ok, err := s.store.PutMessageFor(owner, msg, fname)
+	if err != nil || !ok {
+		t.Fatalf("failed to store %q: %v", data, err)
+	}
+	s.hub.Notify(owner)
+	return msg.Hash
+}
+
+// retrieveResponse is the reply to a retrieve
+type retrieveResponse struct {
+	Messages []model.Message `json:"messages"`
+	LastHash string          `json:"lastHash"`
+	Cursor   string          `json:"cursor"`
+	More     bool            `json:"more"`
+}
+
+// longPoll does a long polling retrieve for owner
+func longPoll(s *Server, owner string) (retrieveResponse, error) {
+	r := httptest.NewRequest(http.MethodPost, "/retrieve", nil)
+	r.Header.Set("X-Loki-recipient", owner)
+	r.Header.Set("X-Loki-long-poll", "true")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var resp retrieveResponse
+	if w.Code != http.StatusOK {
+		return resp, fmt.Errorf("retrieve failed: %d %s", w.Code, w.Body.String())
+	}
+	err := json.NewDecoder(w.Body).Decode(&resp)
+	return resp, err
+}
+
+func TestLongPollTimeout(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.LongPollTimeout = time.Millisecond * 100
+	started := time.Now()
+	resp, err := longPoll(s, testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Messages) != 0 {
+		t.Errorf("got %d messages from an empty mailbox", len(resp.Messages))
+	}
+	if time.Since(started) < s.LongPollTimeout {
+		t.Errorf("returned after %s which is before the timeout", time.Since(started))
+	}
+}
+
+func TestLongPollWakeup(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.LongPollTimeout = time.Minute
+	result := make(chan retrieveResponse)
+	errs := make(chan error, 1)
+	go func() {
+		resp, err := longPoll(s, testOwner)
+		if err != nil {
+			errs <- err
+			return
+		}
+		result <- resp
+	}()
+	// give the request time to start waiting
+	time.Sleep(time.Millisecond * 100)
+	hash := putTestMessage(t, s, testOwner, "hello")
+	select {
+	case resp := <-result:
+		if len(resp.Messages) != 1 || resp.Messages[0].Hash != hash {
+			t.Errorf("got messages %v after wakeup expected %s", resp.Messages, hash)
+		}
+		if resp.LastHash != hash || resp.Cursor != "1" {
+			t.Errorf("got last hash %s cursor %s", resp.LastHash, resp.Cursor)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	case <-time.After(time.Second * 5):
+		t.Fatal("long poll was not woken up by the stored message")
+	}
+}
+
+// tamperingProxy passes requests to a server and can replay its first reply or strip the signatures off its replies
+type tamperingProxy struct {
+	s      *Server
+	access sync.Mutex
+	mode   string
+	first  *httptest.ResponseRecorder
+}
+
+func (p *tamperingProxy) setMode(mode string) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.mode = mode
+}
+
+func (p *tamperingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	p.s.ServeHTTP(rec, r)
+	p.access.Lock()
+	defer p.access.Unlock()
+	if p.first == nil {
+		p.first = rec
+	}
+	switch p.mode {
+	case "replay":
+		rec = p.first
+	case "strip":
+		rec.Header().Del(peer.SignatureHeader)
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	w.Write(rec.Body.Bytes())
+}
+
+func TestSignedResponses(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.Crypto = testCrypto(t)
+	s.Signer = s.Crypto
+	s.SignResponses = true
+	hash := putTestMessage(t, s, testOwner, "hello")
+	proxy := &tamperingProxy{s: s}
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	node := swarm.ServiceNode{
+		PubKey:  hex.EncodeToString(s.Crypto.PublicKey()),
+		Address: host,
+	}
+	node.Port, _ = strconv.Atoi(port)
+	client := peer.NewClient(&network.NetContext{Dialer: new(net.Dialer)}, nil)
+	var req model.RPCRequest
+	json.Unmarshal(retrieveRPC(testOwner), &req)
+
+	var resp retrieveResponse
+	err := client.Post(node, "/v1/storage_rpc", &req, &resp)
+	if err != nil {
+		t.Fatalf("signed retrieve: %s", err.Error())
+	}
+	if len(resp.Messages) != 1 || resp.Messages[0].Hash != hash {
+		t.Fatalf("retrieved %v expected %s", resp.Messages, hash)
+	}
+
+	// a signed reply to one request is no good for another
+	proxy.setMode("replay")
+	err = client.Post(node, "/v1/storage_rpc", &req, nil)
+	if err != peer.ErrBadResponseSignature {
+		t.Errorf("replayed reply gave %v", err)
+	}
+	// they signed before so they must keep signing
+	proxy.setMode("strip")
+	err = client.Post(node, "/v1/storage_rpc", &req, nil)
+	if err != peer.ErrUnsignedResponse {
+		t.Errorf("unsigned reply gave %v", err)
+	}
+	// and signed by the node we asked
+	node.PubKey = hex.EncodeToString(testCrypto(t).PublicKey())
+	proxy.setMode("")
+	err = client.Post(node, "/v1/storage_rpc", &req, nil)
+	if err != peer.ErrBadResponseSignature {
+		t.Errorf("reply signed by another node gave %v", err)
+	}
+}
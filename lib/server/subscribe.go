@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// DefaultMaxSubscriptionsPerIP is the default for Server.MaxSubscriptionsPerIP
+const DefaultMaxSubscriptionsPerIP = 4
+
+// subscriptionKeepAlive is how often we send a comment down idle subscriptions
+const subscriptionKeepAlive = time.Second * 30
+
+// acquireSubscription reserves a subscription slot for a remote ip, returns false if it has too many already
+func (s *Server) acquireSubscription(ip string) bool {
+	s.subscriptionsMutex.Lock()
+	defer s.subscriptionsMutex.Unlock()
+	if s.subscriptions[ip] >= s.MaxSubscriptionsPerIP {
+		return false
+	}
+	s.subscriptions[ip]++
+	return true
+}
+
+// releaseSubscription frees a slot obtained by acquireSubscription
+func (s *Server) releaseSubscription(ip string) {
+	s.subscriptionsMutex.Lock()
+	defer s.subscriptionsMutex.Unlock()
+	s.subscriptions[ip]--
+	if s.subscriptions[ip] <= 0 {
+		delete(s.subscriptions, ip)
+	}
+}
+
+// handleSubscribe streams every new message for a recipient as server sent events
+// the event id is the message hash, clients resume by sending it back as Last-Event-ID or X-Loki-last-hash
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.plain(w, http.StatusNotFound, "not found")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.plain(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	owner := r.Header.Get("X-Loki-recipient")
+	if owner == "" {
+		s.plain(w, http.StatusBadRequest, "no recipient provided")
+		return
+	}
+	lastHash := r.Header.Get("Last-Event-ID")
+	if lastHash == "" {
+		lastHash = r.Header.Get("X-Loki-last-hash")
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.acquireSubscription(ip) {
+		s.plain(w, http.StatusTooManyRequests, "too many subscriptions")
+		return
+	}
+	defer s.releaseSubscription(ip)
+
+	wakeup := s.hub.Subscribe(owner)
+	defer s.hub.Unsubscribe(owner, wakeup)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(subscriptionKeepAlive)
+	defer keepalive.Stop()
+	limit, maxBytes := s.retrieveLimits(0, 0)
+	seq, err := s.resolveCursor(owner, lastHash, "")
+	for {
+		var msgs []model.Message
+		more := false
+		if err == nil {
+			msgs, seq, more, err = s.retrieveMessages(owner, seq, limit, maxBytes)
+		}
+		if err != nil {
+			fmt.Printf("[%s] error retrieving messages: %s\n", time.Now().String(), err.Error())
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", err.Error())
+			flusher.Flush()
+			return
+		}
+		for _, m := range msgs {
+			data, _ := json.Marshal(m)
+			_, err = fmt.Fprintf(w, "id: %s\ndata: %s\n\n", m.Hash, data)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		if more {
+			continue
+		}
+		// only look at the store again once something was stored for owner
+	wait:
+		for {
+			select {
+			case <-wakeup:
+				break wait
+			case <-keepalive.C:
+				_, err = fmt.Fprint(w, ": keepalive\n\n")
+				if err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subscribe opens a subscription to owner's mailbox resuming after lastHash
+func subscribe(t *testing.T, url, owner, lastHash string) *http.Response {
+	r, err := http.NewRequest(http.MethodGet, url+"/v1/subscribe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Loki-recipient", owner)
+	if lastHash != "" {
+		r.Header.Set("Last-Event-ID", lastHash)
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// readEventID reads the next event from a subscription and gives its id, comments are skipped
+func readEventID(r *bufio.Reader) (string, error) {
+	id := ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" && id != "" {
+			return id, nil
+		}
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		}
+	}
+}
+
+func TestSubscribeResume(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	serv := httptest.NewServer(s)
+	defer serv.Close()
+	a := putTestMessage(t, s, testOwner, "a")
+	b := putTestMessage(t, s, testOwner, "b")
+	resp := subscribe(t, serv.URL, testOwner, a)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("subscribe failed: %s", resp.Status)
+	}
+	events := make(chan string)
+	go func() {
+		r := bufio.NewReader(resp.Body)
+		for {
+			id, err := readEventID(r)
+			if err != nil {
+				close(events)
+				return
+			}
+			events <- id
+		}
+	}()
+	next := func() string {
+		select {
+		case id := <-events:
+			return id
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for an event")
+		}
+		return ""
+	}
+	// resumes after a without sending it again
+	if id := next(); id != b {
+		t.Fatalf("first event is %s expected %s", id, b)
+	}
+	c := putTestMessage(t, s, testOwner, "c")
+	if id := next(); id != c {
+		t.Fatalf("event after store is %s expected %s", id, c)
+	}
+}
+
+func TestSubscriptionsPerIP(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	s.MaxSubscriptionsPerIP = 1
+	serv := httptest.NewServer(s)
+	defer serv.Close()
+	first := subscribe(t, serv.URL, testOwner, "")
+	if first.StatusCode != http.StatusOK {
+		t.Fatalf("first subscription failed: %s", first.Status)
+	}
+	second := subscribe(t, serv.URL, testOwner, "")
+	second.Body.Close()
+	if second.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second subscription got %s expected too many requests", second.Status)
+	}
+	first.Body.Close()
+	// the slot is freed once the first one goes away
+	for i := 0; i < 50; i++ {
+		third := subscribe(t, serv.URL, testOwner, "")
+		third.Body.Close()
+		if third.StatusCode == http.StatusOK {
+			return
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	t.Error("subscription slot was not released")
+}
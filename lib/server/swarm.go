@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/majestrate/swarmserv/lib/cryptography"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// snodeInfo is how we tell clients about a service node
+type snodeInfo struct {
+	Address string `json:"address"`
+	Port    string `json:"port"`
+	PubKey  string `json:"pubkey_ed25519"`
+	X25519  string `json:"pubkey_x25519"`
+}
+
+func makeSnodeInfos(nodes []swarm.ServiceNode) []snodeInfo {
+	infos := []snodeInfo{}
+	for _, node := range nodes {
+		x25519 := node.X25519
+		if x25519 == "" {
+			// work it out from the identity key if the service node list left it out
+			pk, _ := hex.DecodeString(node.PubKey)
+			if xpk, err := cryptography.Ed25519PubKeyToX25519(pk); err == nil {
+				x25519 = hex.EncodeToString(xpk)
+			}
+		}
+		infos = append(infos, snodeInfo{
+			Address: node.Host(),
+			Port:    strconv.Itoa(node.Port),
+			PubKey:  node.PubKey,
+			X25519:  x25519,
+		})
+	}
+	return infos
+}
+
+// swarmMembersFor gets the members of the swarm a recipient belongs to
+// replies with an error and returns false on fail
+func (s *Server) swarmMembersFor(w http.ResponseWriter, pubkey string) ([]swarm.ServiceNode, bool) {
+	if s.Swarm == nil || !s.Swarm.Ready() {
+		s.plain(w, http.StatusServiceUnavailable, "service node list not available")
+		return nil, false
+	}
+	id, err := s.Swarm.SwarmFor(pubkey)
+	if err != nil {
+		s.plain(w, http.StatusBadRequest, err.Error())
+		return nil, false
+	}
+	return s.reachable(s.Swarm.MembersOf(id)), true
+}
+
+// reachable drops the service nodes we have marked unreachable
+// if that would leave none we keep them all so clients still have somewhere to go
+func (s *Server) reachable(nodes []swarm.ServiceNode) []swarm.ServiceNode {
+	if s.peers == nil {
+		return nodes
+	}
+	var up []swarm.ServiceNode
+	for _, node := range nodes {
+		if s.peers.Reachable(node) {
+			up = append(up, node)
+		}
+	}
+	if len(up) == 0 {
+		return nodes
+	}
+	return up
+}
+
+// replyGetSnodes sends the members of the swarm a recipient belongs to
+func (s *Server) replyGetSnodes(w http.ResponseWriter, pubkey string) {
+	members, ok := s.swarmMembersFor(w, pubkey)
+	if !ok {
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"snodes": makeSnodeInfos(members),
+	})
+}
+
+// ensureOurSwarm checks that a recipient belongs to our swarm
+// if not replies with the members of the swarm they do belong to and returns false
+// without a service node list we accept every recipient
+func (s *Server) ensureOurSwarm(w http.ResponseWriter, pubkey string) bool {
+	if s.Swarm == nil || !s.Swarm.Ready() || s.Swarm.IsResponsibleFor(pubkey) {
+		return true
+	}
+	members, ok := s.swarmMembersFor(w, pubkey)
+	if !ok {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "wrong_swarm",
+		"snodes": makeSnodeInfos(members),
+	})
+	return false
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/majestrate/swarmserv/lib/model"
+	"github.com/majestrate/swarmserv/lib/swarm"
+)
+
+// ourTestKey is the identity key of the server in tests with a service node list
+var ourTestKey = hex.EncodeToString(make([]byte, 32))
+
+// setServiceNodes gives s a service node list with nodes and us in swarm ourSwarm
+func setServiceNodes(t *testing.T, s *Server, ourSwarm uint64, nodes ...swarm.ServiceNode) {
+	nodes = append(nodes, swarm.ServiceNode{PubKey: ourTestKey, Address: "127.0.0.1", Port: 1, SwarmID: ourSwarm})
+	data, _ := json.Marshal(nodes)
+	nodesFile := filepath.Join(s.root, "nodes.json")
+	err := ioutil.WriteFile(nodesFile, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Swarm = swarm.New(swarm.NewFileSource(nodesFile), ourTestKey)
+	err = s.Swarm.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// otherSwarm is a swarm testOwner belongs to when ours is 0x1000
+var otherSwarm = []swarm.ServiceNode{
+	{PubKey: hex.EncodeToString(make([]byte, 31)) + "01", X25519: "aa", Address: "10.0.0.1", Port: 22021, SwarmID: 0x100},
+	{PubKey: hex.EncodeToString(make([]byte, 31)) + "02", X25519: "bb", Address: "10.0.0.2", Port: 22021, SwarmID: 0x100},
+}
+
+// checkSnodes checks a reply lists the service nodes in otherSwarm
+func checkSnodes(t *testing.T, body []byte) {
+	var resp struct {
+		Snodes []snodeInfo `json:"snodes"`
+	}
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatalf("bad reply %q: %s", body, err.Error())
+	}
+	if len(resp.Snodes) != len(otherSwarm) {
+		t.Fatalf("got %+v expected %+v", resp.Snodes, otherSwarm)
+	}
+	for idx, node := range otherSwarm {
+		info := resp.Snodes[idx]
+		if info.PubKey != node.PubKey || info.X25519 != node.X25519 || info.Address != node.Address || info.Port != "22021" {
+			t.Errorf("got %+v expected %+v", info, node)
+		}
+	}
+}
+
+func TestGetSnodesRPC(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	w := storageRPC(s, "get_snodes_for_pubkey", &model.GetSnodesRequest{PubKey: testOwner})
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("get_snodes_for_pubkey without a service node list got %d", w.Code)
+	}
+
+	setServiceNodes(t, s, 0x1000, otherSwarm...)
+	w = storageRPC(s, "get_snodes_for_pubkey", &model.GetSnodesRequest{PubKey: testOwner})
+	if w.Code != http.StatusOK {
+		t.Fatalf("get_snodes_for_pubkey got %d %s", w.Code, w.Body.String())
+	}
+	checkSnodes(t, w.Body.Bytes())
+
+	w = storageRPC(s, "get_snodes_for_pubkey", &model.GetSnodesRequest{PubKey: "05"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("get_snodes_for_pubkey of an invalid pubkey got %d", w.Code)
+	}
+}
+
+func TestWrongSwarm(t *testing.T) {
+	s, done := testServer(t)
+	defer done()
+	setServiceNodes(t, s, 0x1000, otherSwarm...)
+	w := storageRPC(s, "store", &model.StoreRequest{
+		PubKey:    testOwner,
+		TTL:       "3600",
+		Timestamp: "1",
+		Data:      "hello",
+	})
+	if w.Code != http.StatusMisdirectedRequest {
+		t.Fatalf("store for another swarm got %d %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Status string `json:"status"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Status != "wrong_swarm" {
+		t.Errorf("status %q expected wrong_swarm", resp.Status)
+	}
+	checkSnodes(t, w.Body.Bytes())
+}
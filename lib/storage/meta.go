@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// metaSuffix is appended to a message's filename to get the filename of its metadata
+const metaSuffix = ".meta"
+
+// messageMeta is the metadata stored next to each message body
+type messageMeta struct {
+	Owner               string `json:"owner"`
+	Timestamp           uint64 `json:"timestamp"`
+	TTL                 uint64 `json:"ttl"`
+	ExpirationTimestamp uint64 `json:"expiration"`
+	Nonce               string `json:"nonce"`
+	Seq                 uint64 `json:"seq"`
+	// Deleted is set when the message was deleted, the metadata is kept as a tombstone until it expires
+	Deleted bool `json:"deleted,omitempty"`
+	// Deletion is the recipient's signed request that deleted the message
+	Deletion *model.Deletion `json:"deletion,omitempty"`
+	// ExpiryChange is the recipient's signed request that last changed the expiration
+	ExpiryChange *model.ExpiryChange `json:"expiry_change,omitempty"`
+}
+
+func newMessageMeta(owner string, msg *model.Message) *messageMeta {
+	return &messageMeta{
+		Owner:               owner,
+		Timestamp:           msg.Timestamp,
+		TTL:                 msg.TTL,
+		ExpirationTimestamp: msg.ExpirationTimestamp,
+		Nonce:               msg.Nonce,
+	}
+}
+
+// apply copies the metadata onto msg
+func (m *messageMeta) apply(msg *model.Message) {
+	msg.Timestamp = m.Timestamp
+	msg.TTL = m.TTL
+	msg.ExpirationTimestamp = m.ExpirationTimestamp
+	msg.Nonce = m.Nonce
+	msg.Seq = m.Seq
+}
+
+// isMessageFile returns true if name is a message body, every other file we keep has a dot in its name
+func isMessageFile(name string) bool {
+	return !strings.Contains(name, ".")
+}
+
+// isMetaFile returns true if name is a metadata file or one that is being written
+func isMetaFile(name string) bool {
+	return strings.Contains(name, metaSuffix)
+}
+
+// readMeta reads the metadata for the message stored at msgpath
+func readMeta(msgpath string) (*messageMeta, error) {
+	data, err := ioutil.ReadFile(msgpath + metaSuffix)
+	if err != nil {
+		return nil, err
+	}
+	meta := new(messageMeta)
+	err = json.Unmarshal(data, meta)
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeMeta atomically writes the metadata for the message stored at msgpath
+func writeMeta(msgpath string, meta *messageMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := msgpath + metaSuffix + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, msgpath+metaSuffix)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// writeTombstone removes a message body and marks its metadata as deleted
+func writeTombstone(msgpath string, meta *messageMeta) error {
+	meta.Deleted = true
+	err := writeMeta(msgpath, meta)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(msgpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeMessageFiles removes a message body and its metadata
+func removeMessageFiles(msgpath string) error {
+	os.Remove(msgpath + metaSuffix)
+	return os.Remove(msgpath)
+}
@@ -8,19 +8,31 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/majestrate/swarmserv/lib/model"
-	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var enc = base32.StdEncoding.WithPadding(base32.NoPadding)
 
+// seqFile is the file in each skiplist directory holding the last sequence number given out
+const seqFile = "sequence.last"
+
+// ownerFile is the file in each skiplist directory holding the recipient it belongs to
+// the directory name is a hash of the recipient so it cannot be worked out from that
+const ownerFile = "owner.pubkey"
+
 type fsSkiplistStore struct {
 	root           string
 	expireDuration time.Duration
+	// held while putting messages so sequence numbers are allocated in order
+	// and while changing the metadata of stored messages so changes are not lost
+	putMutex sync.Mutex
 }
 
 func (s *fsSkiplistStore) Init() error {
@@ -28,7 +40,7 @@ func (s *fsSkiplistStore) Init() error {
 	if err != nil {
 		return err
 	}
-	for _, r := range "QWERTYUIOPASDFGHJKLZXCVBNM234567" {
+	for _, r := range buckets {
 		str := string(r)
 		err := s.ensureDir(str)
 		if err != nil {
@@ -61,27 +73,119 @@ func (s *fsSkiplistStore) ensureBucketDir(bucket, dir string) error {
 	return err
 }
 
-func (s *fsSkiplistStore) visitMessage(owner string, f *os.File, since time.Time, visit MessageVisitor) error {
-	var msg model.Message
-	st, err := f.Stat()
-	if err != nil {
-		return err
+// readIndexFor reads the expiration timestamps of the messages in skiplist directory p from the index
+// later entries for the same file override earlier ones
+func (s *fsSkiplistStore) readIndexFor(p string) (map[string]uint64, error) {
+	expires := make(map[string]uint64)
+	f, err := os.Open(filepath.Join(s.root, "index"))
+	if os.IsNotExist(err) {
+		return expires, nil
+	} else if err != nil {
+		return nil, err
 	}
-	mod := st.ModTime()
-	if mod.Before(since) {
-		return nil
+	defer f.Close()
+	prefix := p + string(filepath.Separator)
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		parts := strings.Split(scan.Text(), " ")
+		if len(parts) == 2 && strings.HasPrefix(parts[0], prefix) {
+			t, err := strconv.ParseUint(parts[1], 10, 64)
+			if err == nil {
+				expires[parts[0]] = t
+			}
+		}
+	}
+	return expires, scan.Err()
+}
+
+// storedMessage is a message file found in a recipient's skiplist directory
+type storedMessage struct {
+	path string
+	hash []byte
+	meta *messageMeta
+	mod  time.Time
+	size int64
+}
+
+// listMessages lists all messages in a skiplist directory ordered by sequence number
+func (s *fsSkiplistStore) listMessages(p string) ([]storedMessage, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	hash, err := enc.DecodeString(st.Name())
+	names, err := f.Readdirnames(0)
+	f.Close()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var msgs []storedMessage
+	for _, name := range names {
+		if !isMessageFile(name) {
+			continue
+		}
+		hash, err := enc.DecodeString(name)
+		if err != nil {
+			continue
+		}
+		fpath := filepath.Join(p, name)
+		st, err := os.Stat(fpath)
+		if err != nil {
+			continue
+		}
+		meta, err := s.loadMeta(fpath, st)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, storedMessage{
+			path: fpath,
+			hash: hash,
+			meta: meta,
+			mod:  st.ModTime(),
+			size: st.Size(),
+		})
 	}
-	msg.Hash = hex.EncodeToString(hash)
-	msg.ExpirationTimestamp = uint64(mod.Add(s.expireDuration).Unix())
-	buff := make([]byte, st.Size())
-	_, err = io.ReadFull(f, buff)
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].meta.Seq == msgs[j].meta.Seq {
+			return msgs[i].mod.Before(msgs[j].mod)
+		}
+		return msgs[i].meta.Seq < msgs[j].meta.Seq
+	})
+	return msgs, nil
+}
+
+// loadMeta loads the metadata for the message file at fpath
+func (s *fsSkiplistStore) loadMeta(fpath string, st os.FileInfo) (*messageMeta, error) {
+	meta, err := readMeta(fpath)
+	if !os.IsNotExist(err) {
+		return meta, err
+	}
+	// stored before we kept metadata, the index still has its expiration
+	meta = &messageMeta{
+		ExpirationTimestamp: uint64(st.ModTime().Add(s.expireDuration).Unix()),
+	}
+	expires, err := s.readIndexFor(filepath.Dir(fpath))
 	if err != nil {
+		return nil, err
+	}
+	if t, ok := expires[fpath]; ok {
+		meta.ExpirationTimestamp = t
+	}
+	return meta, nil
+}
+
+func (s *fsSkiplistStore) visitMessage(m storedMessage, visit MessageVisitor) error {
+	var msg model.Message
+	buff, err := ioutil.ReadFile(m.path)
+	if os.IsNotExist(err) {
+		// removed while we were iterating
+		return nil
+	} else if err != nil {
 		return err
 	}
+	msg.Hash = hex.EncodeToString(m.hash)
+	m.meta.apply(&msg)
 	msg.Data = string(buff)
 	return visit(msg)
 }
@@ -93,59 +197,145 @@ func (s *fsSkiplistStore) Mktemp() string {
 }
 
 func (s *fsSkiplistStore) IterAllFor(owner string, visit MessageVisitor) error {
-	return s.iterAllForSince(owner, visit, time.Unix(0, 0))
+	return s.iterAfterSeq(owner, 0, visit)
 }
 
-func (s *fsSkiplistStore) iterAllForSince(owner string, visit MessageVisitor, since time.Time) error {
+// iterAfterSeq visits every message for owner with a sequence number after seq in order, visits all messages if seq is 0
+func (s *fsSkiplistStore) iterAfterSeq(owner string, seq uint64, visit MessageVisitor) error {
 	bucket, dir := s.getSkiplistFor(owner)
-	err := s.ensureBucketDir(bucket, dir)
+	msgs, err := s.listMessages(filepath.Join(s.root, bucket, dir))
 	if err != nil {
 		return err
 	}
-	p := filepath.Join(s.root, bucket, dir)
-	_, err = os.Stat(p)
-	if err == nil {
-		f, err := os.Open(p)
-		if err != nil {
-			return err
+	for _, m := range msgs {
+		if seq > 0 && m.meta.Seq <= seq {
+			continue
 		}
-		defer f.Close()
-		names, err := f.Readdirnames(0)
-		if err != nil {
+		err = s.visitMessage(m, visit)
+		if err == ErrStopIteration {
+			return nil
+		} else if err != nil {
 			return err
 		}
-		for _, name := range names {
-			f, err := os.Open(filepath.Join(p, name))
-			if err == nil {
-				defer f.Close()
-				err = s.visitMessage(owner, f, since, visit)
-				if err != nil {
-					return err
-				}
-			}
+	}
+	return nil
+}
+
+// iterPageAfterSeq is iterAfterSeq but stops once the page is full, see IterPageSinceSeqFor
+func (s *fsSkiplistStore) iterPageAfterSeq(owner string, seq uint64, limit, maxBytes int, visit MessageVisitor) (bool, error) {
+	bucket, dir := s.getSkiplistFor(owner)
+	msgs, err := s.listMessages(filepath.Join(s.root, bucket, dir))
+	if err != nil {
+		return false, err
+	}
+	count := 0
+	var size int64
+	for _, m := range msgs {
+		if seq > 0 && m.meta.Seq <= seq {
+			continue
 		}
-	} else if os.IsNotExist(err) {
-		return nil
+		if count > 0 && (count >= limit || size+m.size > int64(maxBytes)) {
+			// the size is known from the directory listing so we never load this one
+			return true, nil
+		}
+		err = s.visitMessage(m, visit)
+		if err == ErrStopIteration {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		count++
+		size += m.size
 	}
-	return err
+	return false, nil
 }
 
 func (s *fsSkiplistStore) IterSinceHashFor(owner string, hash []byte, visit MessageVisitor) error {
-	if hash == nil {
+	if len(hash) == 0 {
 		return s.IterAllFor(owner, visit)
 	}
+	seq, err := s.LookupSeqFor(owner, hash)
+	if err == ErrUnknownCursor {
+		return s.IterAllFor(owner, visit)
+	} else if err != nil {
+		return err
+	}
+	return s.iterAfterSeq(owner, seq, visit)
+}
+
+func (s *fsSkiplistStore) IterPageSinceSeqFor(owner string, seq uint64, limit, maxBytes int, visit MessageVisitor) (bool, error) {
 	bucket, dir := s.getSkiplistFor(owner)
-	err := s.ensureBucketDir(bucket, dir)
+	// directories from before we kept metadata learn their owner once the owner retrieves
+	s.recordOwner(filepath.Join(s.root, bucket, dir), owner)
+	last, err := s.readSeq(filepath.Join(s.root, bucket, dir))
 	if err != nil {
-		return err
+		return false, err
 	}
-	fname := filepath.Join(s.root, bucket, dir, enc.EncodeToString(hash))
-	stat, err := os.Stat(fname)
-	if err == nil {
-		since := stat.ModTime()
-		err = s.iterAllForSince(owner, visit, since)
+	if seq > last {
+		return false, ErrUnknownCursor
 	}
-	return err
+	return s.iterPageAfterSeq(owner, seq, limit, maxBytes, visit)
+}
+
+func (s *fsSkiplistStore) GetMessageFor(owner string, hash []byte) (*model.Message, error) {
+	bucket, dir := s.getSkiplistFor(owner)
+	fname := s.getFilenameFor(bucket, dir, hash)
+	st, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return nil, ErrNoSuchMessage
+	} else if err != nil {
+		return nil, err
+	}
+	meta, err := s.loadMeta(fname, st)
+	if err != nil {
+		return nil, err
+	}
+	var msg *model.Message
+	err = s.visitMessage(storedMessage{path: fname, hash: hash, meta: meta, mod: st.ModTime()}, func(m model.Message) error {
+		msg = &m
+		return nil
+	})
+	if err == nil && msg == nil {
+		err = ErrNoSuchMessage
+	}
+	return msg, err
+}
+
+func (s *fsSkiplistStore) LookupSeqFor(owner string, hash []byte) (uint64, error) {
+	bucket, dir := s.getSkiplistFor(owner)
+	meta, err := readMeta(s.getFilenameFor(bucket, dir, hash))
+	if os.IsNotExist(err) {
+		return 0, ErrUnknownCursor
+	} else if err != nil {
+		return 0, err
+	}
+	return meta.Seq, nil
+}
+
+// readSeq reads the last sequence number given out in a skiplist directory
+func (s *fsSkiplistStore) readSeq(p string) (uint64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(p, seqFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// nextSeq allocates the next sequence number in a skiplist directory, must be called with putMutex held
+func (s *fsSkiplistStore) nextSeq(p string) (uint64, error) {
+	seq, err := s.readSeq(p)
+	if err != nil {
+		return 0, err
+	}
+	seq++
+	tmp := filepath.Join(p, seqFile+".tmp")
+	err = ioutil.WriteFile(tmp, []byte(strconv.FormatUint(seq, 10)), 0600)
+	if err != nil {
+		return 0, err
+	}
+	return seq, os.Rename(tmp, filepath.Join(p, seqFile))
 }
 
 func (s *fsSkiplistStore) getFilenameFor(bucket, dir string, hash []byte) string {
@@ -219,11 +409,12 @@ func (s *fsSkiplistStore) appendIndexExpireEntry(fullpath string, expiresAt uint
 	return err
 }
 
-func (s *fsSkiplistStore) Expire() error {
+// rewriteIndex rewrites the expiration index keeping only the entries where keep returns true
+func (s *fsSkiplistStore) rewriteIndex(keep func(fullpath string, expiresAt uint64) bool) error {
 	_, err := os.Stat(filepath.Join(s.root, "index"))
 	if err == nil {
 		return s.withIndexLock(func() error {
-			newf, err := os.OpenFile(filepath.Join(s.root, "index.new"), os.O_CREATE|os.O_WRONLY, 0700)
+			newf, err := os.OpenFile(filepath.Join(s.root, "index.new"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0700)
 			if err != nil {
 				return err
 			}
@@ -233,7 +424,6 @@ func (s *fsSkiplistStore) Expire() error {
 				os.Remove(filepath.Join(s.root, "index.new"))
 				return err
 			}
-			now := uint64(time.Now().Unix())
 			scan := bufio.NewScanner(f)
 			for scan.Scan() {
 				parts := strings.Split(scan.Text(), " ")
@@ -241,14 +431,7 @@ func (s *fsSkiplistStore) Expire() error {
 					// sanity check
 					if strings.HasPrefix(parts[0], s.root) && strings.Index(parts[0], "..") == -1 {
 						t, err := strconv.ParseUint(parts[1], 10, 64)
-						if err == nil && now >= t {
-							// expire old file and discard index entry
-							fmt.Printf("expire %s\n", parts[0])
-							e := os.Remove(parts[0])
-							if e != nil {
-								fmt.Printf("error: %s\n", e.Error())
-							}
-						} else {
+						if err != nil || keep(parts[0], t) {
 							// write new index contents
 							fmt.Fprintf(newf, "%s %s\n", parts[0], parts[1])
 						}
@@ -268,6 +451,245 @@ func (s *fsSkiplistStore) Expire() error {
 	}
 }
 
+func (s *fsSkiplistStore) Expire() error {
+	now := uint64(time.Now().Unix())
+	return s.rewriteIndex(func(fullpath string, expiresAt uint64) bool {
+		if now < expiresAt {
+			return true
+		}
+		// expire old file and discard index entry
+		fmt.Printf("expire %s\n", fullpath)
+		e := removeMessageFiles(fullpath)
+		if e != nil && !os.IsNotExist(e) {
+			fmt.Printf("error: %s\n", e.Error())
+		}
+		return false
+	})
+}
+
+func (s *fsSkiplistStore) DeleteMessages(owner string, hashes [][]byte, del *model.Deletion) ([][]byte, error) {
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	var deleted [][]byte
+	bucket, dir := s.getSkiplistFor(owner)
+	for _, hash := range hashes {
+		fname := s.getFilenameFor(bucket, dir, hash)
+		ok, err := s.deleteMessage(owner, fname, del)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted = append(deleted, hash)
+		}
+	}
+	return deleted, nil
+}
+
+// deleteMessage replaces the message at fname with a tombstone, returns false if there was no message
+// the tombstone is the metadata marked as deleted, the index entry is left for Expire to remove it
+// must be called with putMutex held
+func (s *fsSkiplistStore) deleteMessage(owner, fname string, del *model.Deletion) (bool, error) {
+	st, err := os.Stat(fname)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	meta, err := s.loadMeta(fname, st)
+	if err != nil {
+		return false, err
+	}
+	meta.Owner = owner
+	meta.Deletion = del
+	return true, writeTombstone(fname, meta)
+}
+
+// DeleteAllFor turns every message in owner's skiplist directory into a tombstone
+// tombstones are needed so sync does not fetch the messages back from peers that still have them
+// the index entries are kept so Expire removes the tombstones at the original expiration
+func (s *fsSkiplistStore) DeleteAllFor(owner string, del *model.Deletion) ([][]byte, error) {
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	var deleted [][]byte
+	bucket, dir := s.getSkiplistFor(owner)
+	p := filepath.Join(s.root, bucket, dir)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if !isMessageFile(name) {
+			continue
+		}
+		hash, err := enc.DecodeString(name)
+		if err != nil {
+			continue
+		}
+		ok, err := s.deleteMessage(owner, filepath.Join(p, name), del)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted = append(deleted, hash)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *fsSkiplistStore) ForgetAllFor(owner string) error {
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	bucket, dir := s.getSkiplistFor(owner)
+	// index entries for these files are dropped when they expire
+	return os.RemoveAll(filepath.Join(s.root, bucket, dir))
+}
+
+func (s *fsSkiplistStore) Owners() ([]string, error) {
+	var owners []string
+	for _, r := range buckets {
+		p := filepath.Join(s.root, string(r))
+		dirs, err := readDirNames(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			owner := s.ownerOf(filepath.Join(p, dir))
+			if owner != "" {
+				owners = append(owners, owner)
+			}
+		}
+	}
+	return owners, nil
+}
+
+// ownerOf finds who a skiplist directory belongs to from its owner file or else the metadata of its messages
+// returns an empty string for a directory that only has messages from before we kept either
+func (s *fsSkiplistStore) ownerOf(p string) string {
+	data, err := ioutil.ReadFile(filepath.Join(p, ownerFile))
+	if err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	names, err := readDirNames(p)
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		meta, err := readMeta(filepath.Join(p, strings.TrimSuffix(name, metaSuffix)))
+		if err == nil && meta.Owner != "" {
+			s.recordOwner(p, meta.Owner)
+			return meta.Owner
+		}
+	}
+	return ""
+}
+
+// recordOwner writes the owner file of an existing skiplist directory if it does not have one yet
+func (s *fsSkiplistStore) recordOwner(p, owner string) {
+	_, err := os.Stat(filepath.Join(p, ownerFile))
+	if !os.IsNotExist(err) {
+		return
+	}
+	if _, err = os.Stat(p); err != nil {
+		return
+	}
+	tmp := filepath.Join(p, ownerFile+".tmp")
+	err = ioutil.WriteFile(tmp, []byte(owner), 0600)
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(p, ownerFile))
+	}
+	if err != nil {
+		fmt.Printf("failed to record owner of %s: %s\n", p, err.Error())
+	}
+}
+
+func (s *fsSkiplistStore) PutTombstoneFor(owner string, hash []byte, expiresAt uint64, del *model.Deletion) error {
+	bucket, dir := s.getSkiplistFor(owner)
+	err := s.ensureBucketDir(bucket, dir)
+	if err != nil {
+		return err
+	}
+	s.recordOwner(filepath.Join(s.root, bucket, dir), owner)
+	fname := s.getFilenameFor(bucket, dir, hash)
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	ok, err := s.deleteMessage(owner, fname, del)
+	if ok || err != nil {
+		return err
+	}
+	_, err = readMeta(fname)
+	if err == nil {
+		// already have a tombstone
+		return nil
+	}
+	err = s.appendIndexExpireEntry(fname, expiresAt)
+	if err != nil {
+		return err
+	}
+	return writeTombstone(fname, &messageMeta{
+		Owner:               owner,
+		ExpirationTimestamp: expiresAt,
+		Deletion:            del,
+	})
+}
+
+func (s *fsSkiplistStore) UpdateExpiry(owner string, hashes [][]byte, expiresAt uint64, change *model.ExpiryChange) ([][]byte, error) {
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	var updated [][]byte
+	changed := make(map[string]bool)
+	bucket, dir := s.getSkiplistFor(owner)
+	for _, hash := range hashes {
+		fname := s.getFilenameFor(bucket, dir, hash)
+		_, err := os.Stat(fname)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		meta, err := readMeta(fname)
+		if os.IsNotExist(err) {
+			meta = &messageMeta{Owner: owner}
+		} else if err != nil {
+			return nil, err
+		}
+		meta.ExpirationTimestamp = expiresAt
+		meta.ExpiryChange = change
+		err = writeMeta(fname, meta)
+		if err != nil {
+			return nil, err
+		}
+		updated = append(updated, hash)
+		changed[fname] = true
+	}
+	if len(changed) == 0 {
+		return updated, nil
+	}
+	// drop the old index entries and put in the new ones
+	err := s.rewriteIndex(func(fullpath string, _ uint64) bool {
+		return !changed[fullpath]
+	})
+	if err != nil {
+		return nil, err
+	}
+	for fname := range changed {
+		err = s.appendIndexExpireEntry(fname, expiresAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return updated, nil
+}
+
 func (s *fsSkiplistStore) PutMessageFor(owner string, msg *model.Message, infname string) (bool, error) {
 	bucket, dir := s.getSkiplistFor(owner)
 	err := s.ensureDir(bucket)
@@ -278,16 +700,34 @@ func (s *fsSkiplistStore) PutMessageFor(owner string, msg *model.Message, infnam
 	if err != nil {
 		return false, err
 	}
+	s.recordOwner(filepath.Join(s.root, bucket, dir), owner)
 	hash, _ := hex.DecodeString(msg.Hash)
 	outfname := s.getFilenameFor(bucket, dir, hash)
+	s.putMutex.Lock()
+	defer s.putMutex.Unlock()
+	if meta, err := readMeta(outfname); err == nil && meta.Deleted {
+		// deleted messages stay deleted
+		return false, nil
+	}
 	_, e := os.Stat(outfname)
 	if os.IsNotExist(e) {
+		seq, err := s.nextSeq(filepath.Join(s.root, bucket, dir))
+		if err != nil {
+			return false, err
+		}
 		err = s.appendIndexExpireEntry(outfname, msg.ExpirationTimestamp)
 		if err != nil {
 			return false, err
 		}
-		err := os.Rename(infname, outfname)
+		meta := newMessageMeta(owner, msg)
+		meta.Seq = seq
+		err = writeMeta(outfname, meta)
+		if err != nil {
+			return false, err
+		}
+		err = os.Rename(infname, outfname)
 		if err != nil {
+			os.Remove(outfname + metaSuffix)
 			return false, err
 		}
 		return true, nil
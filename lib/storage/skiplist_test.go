@@ -0,0 +1,435 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+const testOwner = "0500000000000000000000000000000000000000000000000000000000000000ff"
+
+// testStore makes a store in a new temp dir, call the returned func to remove it
+func testStore(t *testing.T) (*fsSkiplistStore, func()) {
+	dir, err := ioutil.TempDir("", "swarmserv-storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSkiplistStore(dir).(*fsSkiplistStore)
+	err = s.Init()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// putTestMessage stores data for owner expiring an hour from now and returns its hash
+func putTestMessage(t *testing.T, s Store, owner, data string) []byte {
+	return putTestMessageExpiring(t, s, owner, data, uint64(time.Now().Add(time.Hour).Unix()))
+}
+
+// putTestMessageExpiring stores data for owner expiring at expiresAt and returns its hash
+func putTestMessageExpiring(t *testing.T, s Store, owner, data string, expiresAt uint64) []byte {
+	h := sha256.Sum256([]byte(owner + data))
+	fname := s.Mktemp()
+	err := ioutil.WriteFile(fname, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &model.Message{
+		Hash:                hex.EncodeToString(h[:]),
+		Timestamp:           uint64(time.Now().Unix() * 1000),
+		TTL:                 3600 * 1000,
+		ExpirationTimestamp: expiresAt,
+		Data:                data,
+	}
+	ok, err := s.PutMessageFor(owner, msg, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("message %q was not stored", data)
+	}
+	return h[:]
+}
+
+// readIndex reads the expiration index as a map of file path to expiration
+func readIndex(t *testing.T, s *fsSkiplistStore) map[string]string {
+	index := make(map[string]string)
+	f, err := os.Open(filepath.Join(s.root, "index"))
+	if os.IsNotExist(err) {
+		return index
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		parts := strings.Split(scan.Text(), " ")
+		index[parts[0]] = parts[1]
+	}
+	return index
+}
+
+// listData gets the data of every message stored for owner in order
+func listData(t *testing.T, s Store, owner string) []string {
+	var data []string
+	err := s.IterAllFor(owner, func(m model.Message) error {
+		data = append(data, m.Data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDeleteAndExpire(t *testing.T) {
+	past := uint64(time.Now().Add(-time.Minute).Unix())
+	tests := []struct {
+		name string
+		// change gets the hashes of the stored messages a, b and c and changes some of them
+		// it returns the hashes the change reports
+		change  func(s *fsSkiplistStore, hashes [][]byte) ([][]byte, error)
+		changed []int
+		// left is the data of the messages we still have after expiring
+		left []string
+		// indexed is which of a, b and c still have an index entry after expiring
+		indexed []int
+	}{
+		{
+			name: "delete",
+			change: func(s *fsSkiplistStore, hashes [][]byte) ([][]byte, error) {
+				return s.DeleteMessages(testOwner, [][]byte{hashes[0], hashes[2], {1, 2, 3}}, nil)
+			},
+			changed: []int{0, 2},
+			left:    []string{"b"},
+			// tombstones keep their entry until they expire
+			indexed: []int{0, 1, 2},
+		},
+		{
+			name: "delete_all",
+			change: func(s *fsSkiplistStore, hashes [][]byte) ([][]byte, error) {
+				return s.DeleteAllFor(testOwner, nil)
+			},
+			changed: []int{0, 1, 2},
+			indexed: []int{0, 1, 2},
+		},
+		{
+			name: "expire",
+			change: func(s *fsSkiplistStore, hashes [][]byte) ([][]byte, error) {
+				return s.UpdateExpiry(testOwner, [][]byte{hashes[1], {1, 2, 3}}, past, nil)
+			},
+			changed: []int{1},
+			left:    []string{"a", "c"},
+			indexed: []int{0, 2},
+		},
+		{
+			name: "delete then expire",
+			change: func(s *fsSkiplistStore, hashes [][]byte) ([][]byte, error) {
+				_, err := s.DeleteMessages(testOwner, hashes[:1], nil)
+				if err != nil {
+					return nil, err
+				}
+				return s.UpdateExpiry(testOwner, hashes[:2], past, nil)
+			},
+			// only messages we still have can have their expiration changed
+			changed: []int{1},
+			left:    []string{"c"},
+			indexed: []int{0, 2},
+		},
+	}
+	for _, test := range tests {
+		s, done := testStore(t)
+		var hashes [][]byte
+		for _, data := range []string{"a", "b", "c"} {
+			hashes = append(hashes, putTestMessage(t, s, testOwner, data))
+		}
+		changed, err := test.change(s, hashes)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(changed) != len(test.changed) {
+			t.Errorf("%s: changed %d messages expected %d", test.name, len(changed), len(test.changed))
+		}
+		// delete_all reports them in directory order
+		for _, i := range test.changed {
+			found := false
+			for _, h := range changed {
+				found = found || bytes.Equal(h, hashes[i])
+			}
+			if !found {
+				t.Errorf("%s: message %d was not reported as changed", test.name, i)
+			}
+		}
+		err = s.Expire()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if got := listData(t, s, testOwner); fmt.Sprint(got) != fmt.Sprint(test.left) {
+			t.Errorf("%s: have messages %v expected %v", test.name, got, test.left)
+		}
+		index := readIndex(t, s)
+		if len(index) != len(test.indexed) {
+			t.Errorf("%s: index has %d entries expected %d", test.name, len(index), len(test.indexed))
+		}
+		bucket, dir := s.getSkiplistFor(testOwner)
+		for _, i := range test.indexed {
+			if _, ok := index[s.getFilenameFor(bucket, dir, hashes[i])]; !ok {
+				t.Errorf("%s: no index entry for message %d", test.name, i)
+			}
+		}
+		done()
+	}
+}
+
+func TestExpireReportedOnRetrieve(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	hash := putTestMessage(t, s, testOwner, "a")
+	expiry := uint64(time.Now().Add(time.Minute * 5).Unix())
+	_, err := s.UpdateExpiry(testOwner, [][]byte{hash}, expiry, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.GetMessageFor(testOwner, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.ExpirationTimestamp != expiry {
+		t.Errorf("retrieved expiration %d expected %d", msg.ExpirationTimestamp, expiry)
+	}
+	bucket, dir := s.getSkiplistFor(testOwner)
+	if got := readIndex(t, s)[s.getFilenameFor(bucket, dir, hash)]; got != fmt.Sprint(expiry) {
+		t.Errorf("index expiration %s expected %d", got, expiry)
+	}
+}
+
+func TestSeqSurvivesRestart(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	putTestMessage(t, s, testOwner, "a")
+	putTestMessage(t, s, testOwner, "b")
+	// a restart only keeps what is on disk
+	s = NewSkiplistStore(filepath.Dir(s.root)).(*fsSkiplistStore)
+	err := s.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := putTestMessage(t, s, testOwner, "c")
+	seq, err := s.LookupSeqFor(testOwner, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 3 {
+		t.Errorf("got seq %d after restart expected 3", seq)
+	}
+	// deleting everything does not reset the sequence either
+	_, err = s.DeleteAllFor(testOwner, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash = putTestMessage(t, s, testOwner, "d")
+	seq, err = s.LookupSeqFor(testOwner, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != 4 {
+		t.Errorf("got seq %d after delete_all expected 4", seq)
+	}
+}
+
+func TestUnknownCursor(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	a := putTestMessage(t, s, testOwner, "a")
+	putTestMessage(t, s, testOwner, "b")
+	_, err := s.UpdateExpiry(testOwner, [][]byte{a}, uint64(time.Now().Add(-time.Minute).Unix()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		hash []byte
+	}{
+		{"expired", a},
+		{"unknown", []byte{1, 2, 3}},
+	}
+	for _, test := range tests {
+		_, err = s.LookupSeqFor(testOwner, test.hash)
+		if err != ErrUnknownCursor {
+			t.Errorf("%s: lookup got %v expected unknown cursor", test.name, err)
+		}
+		var data []string
+		err = s.IterSinceHashFor(testOwner, test.hash, func(m model.Message) error {
+			data = append(data, m.Data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if fmt.Sprint(data) != "[b]" {
+			t.Errorf("%s: iterated %v expected the whole mailbox", test.name, data)
+		}
+	}
+	_, err = s.IterPageSinceSeqFor(testOwner, 3, 1, 1, func(model.Message) error { return nil })
+	if err != ErrUnknownCursor {
+		t.Errorf("page with seq never given out got %v expected unknown cursor", err)
+	}
+}
+
+func TestIterPage(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	for _, data := range []string{"aa", "bb", "cccc", "d"} {
+		putTestMessage(t, s, testOwner, data)
+	}
+	tests := []struct {
+		seq      uint64
+		limit    int
+		maxBytes int
+		data     []string
+		more     bool
+	}{
+		{0, 10, 100, []string{"aa", "bb", "cccc", "d"}, false},
+		{0, 4, 100, []string{"aa", "bb", "cccc", "d"}, false},
+		{0, 3, 100, []string{"aa", "bb", "cccc"}, true},
+		{0, 10, 4, []string{"aa", "bb"}, true},
+		{0, 10, 8, []string{"aa", "bb", "cccc"}, true},
+		{0, 10, 9, []string{"aa", "bb", "cccc", "d"}, false},
+		// always at least one message even if it is too big
+		{2, 10, 1, []string{"cccc"}, true},
+		{3, 1, 1, []string{"d"}, false},
+		{4, 10, 100, nil, false},
+	}
+	for _, test := range tests {
+		var data []string
+		more, err := s.IterPageSinceSeqFor(testOwner, test.seq, test.limit, test.maxBytes, func(m model.Message) error {
+			data = append(data, m.Data)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("seq=%d limit=%d max_bytes=%d: %s", test.seq, test.limit, test.maxBytes, err)
+		}
+		if fmt.Sprint(data) != fmt.Sprint(test.data) || more != test.more {
+			t.Errorf("seq=%d limit=%d max_bytes=%d: got %v more=%t expected %v more=%t", test.seq, test.limit, test.maxBytes, data, more, test.data, test.more)
+		}
+	}
+}
+
+// restore tries to store data for owner again, returns true if it was stored
+func restore(t *testing.T, s Store, owner, data string) bool {
+	h := sha256.Sum256([]byte(owner + data))
+	fname := s.Mktemp()
+	defer os.Remove(fname)
+	err := ioutil.WriteFile(fname, []byte(data), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := s.PutMessageFor(owner, &model.Message{
+		Hash:                hex.EncodeToString(h[:]),
+		ExpirationTimestamp: uint64(time.Now().Add(time.Hour).Unix()),
+	}, fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestTombstones(t *testing.T) {
+	tests := []struct {
+		name string
+		// expiresAt is when the deleted message would have expired
+		expiresAt time.Duration
+		deleteAll bool
+		// stored is whether storing the message again after Expire works
+		stored bool
+	}{
+		{"delete", time.Hour, false, false},
+		{"delete_all", time.Hour, true, false},
+		{"expired delete", -time.Minute, false, true},
+		{"expired delete_all", -time.Minute, true, true},
+	}
+	for _, test := range tests {
+		s, done := testStore(t)
+		hash := putTestMessageExpiring(t, s, testOwner, "a", uint64(time.Now().Add(test.expiresAt).Unix()))
+		var err error
+		if test.deleteAll {
+			_, err = s.DeleteAllFor(testOwner, nil)
+		} else {
+			_, err = s.DeleteMessages(testOwner, [][]byte{hash}, nil)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if restore(t, s, testOwner, "a") {
+			t.Errorf("%s: deleted message was stored again before expiring", test.name)
+		}
+		err = s.Expire()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		bucket, dir := s.getSkiplistFor(testOwner)
+		_, err = readMeta(s.getFilenameFor(bucket, dir, hash))
+		if test.stored == (err == nil) {
+			t.Errorf("%s: tombstone kept is %t expected %t", test.name, err == nil, !test.stored)
+		}
+		if restore(t, s, testOwner, "a") != test.stored {
+			t.Errorf("%s: storing again after expire expected %t", test.name, test.stored)
+		}
+		done()
+	}
+}
+
+func TestOwners(t *testing.T) {
+	s, done := testStore(t)
+	defer done()
+	putTestMessage(t, s, testOwner, "a")
+	// a message from before we kept metadata or owner files
+	legacy := "05" + strings.Repeat("ab", 32)
+	bucket, dir := s.getSkiplistFor(legacy)
+	err := s.ensureBucketDir(bucket, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.Sum256([]byte("legacy"))
+	err = ioutil.WriteFile(s.getFilenameFor(bucket, dir, h[:]), []byte("legacy"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err := s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(owners) != fmt.Sprint([]string{testOwner}) {
+		t.Errorf("got owners %v before the legacy owner retrieved", owners)
+	}
+	_, err = s.IterPageSinceSeqFor(legacy, 0, 10, 100, func(model.Message) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners, err = s.Owners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 {
+		t.Errorf("got owners %v after the legacy owner retrieved", owners)
+	}
+	if got := listData(t, s, legacy); fmt.Sprint(got) != "[legacy]" {
+		t.Errorf("legacy mailbox has %v", got)
+	}
+}
@@ -1,24 +1,79 @@
 package storage
 
 import (
+	"errors"
 	"github.com/majestrate/swarmserv/lib/model"
 	"path/filepath"
 	"time"
 )
 
 // MessageVisitor visits a message that was loaded
+// returning ErrStopIteration ends the iteration early without an error
 type MessageVisitor func(model.Message) error
 
+// ErrStopIteration is returned by a MessageVisitor to stop iterating
+var ErrStopIteration = errors.New("stop iteration")
+
+// ErrNoSuchMessage is returned when looking up a message we do not have
+var ErrNoSuchMessage = errors.New("no such message")
+
+// ErrUnknownCursor is returned when resuming from a message or sequence number we do not know about
+var ErrUnknownCursor = errors.New("unknown cursor")
+
 type Store interface {
 	// Init intializes the storage backend
 	Init() error
 	// IterAllFor iterates over all messages for owner
 	IterAllFor(owner string, visit MessageVisitor) error
 	// IterSinceHashFor iterates over all messages received after the message with hash
-	// hash may be nil
+	// hash may be nil or empty, if we do not have the message with hash we iterate over all messages
 	IterSinceHashFor(owner string, hash []byte, Visit MessageVisitor) error
+	// IterPageSinceSeqFor iterates in order over the messages received after sequence number seq
+	// it stops after limit messages or before the data of the visited messages would go over maxBytes, it always visits at least one message
+	// a seq of 0 iterates from the first message, returns ErrUnknownCursor if seq was never given out
+	// returns true if there are more messages after the page, found without loading them
+	IterPageSinceSeqFor(owner string, seq uint64, limit, maxBytes int, visit MessageVisitor) (bool, error)
+	// LookupSeqFor gets the sequence number of the message with hash
+	// returns ErrUnknownCursor if we do not have the message
+	LookupSeqFor(owner string, hash []byte) (uint64, error)
+	// GetMessageFor loads the message for owner with hash
+	// returns ErrNoSuchMessage if we do not have it
+	GetMessageFor(owner string, hash []byte) (*model.Message, error)
 	// PutMessageFor puts a message for owner
+	// returns false without an error if we already have the message or a tombstone for it
 	PutMessageFor(owner string, msg *model.Message, bodyFilePath string) (bool, error)
+	// DeleteMessages deletes messages for owner by hash, leaving tombstones so they are not stored again
+	// a tombstone keeps the message's metadata and index entry and is removed by Expire when the message would have expired
+	// until then storing the same message again is refused like a duplicate
+	// del is the signed request kept in the tombstones
+	// returns the hashes of the messages that were removed
+	DeleteMessages(owner string, hashes [][]byte, del *model.Deletion) ([][]byte, error)
+	// DeleteAllFor deletes every message stored for owner, leaving tombstones so they are not stored again
+	// the message bodies are removed but their metadata stays as tombstones and their index entries stay
+	// so that the tombstones expire when the messages would have, the sequence number is kept so cursors stay valid
+	// del is the signed request kept in the tombstones
+	// returns the hashes of the messages that were removed
+	DeleteAllFor(owner string, del *model.Deletion) ([][]byte, error)
+	// ForgetAllFor removes every message and tombstone stored for owner without leaving tombstones
+	// used once they have been handed off to another swarm
+	ForgetAllFor(owner string) error
+	// Owners lists every recipient we have messages or tombstones for
+	// recipients whose messages are all from before we kept metadata are only known once they store or retrieve again
+	Owners() ([]string, error)
+	// PutTombstoneFor marks the message for owner with hash as deleted by del until expiresAt, whether we have it or not
+	// the caller checks del first
+	PutTombstoneFor(owner string, hash []byte, expiresAt uint64, del *model.Deletion) error
+	// BucketDigests gets a digest of the messages and tombstones in every bucket, keyed by bucket name
+	// the digest covers the expiration of messages but not of tombstones
+	BucketDigests() (map[string]string, error)
+	// BucketEntries lists the messages and tombstones in a bucket
+	BucketEntries(bucket string) ([]model.SyncEntry, error)
+	// TombstonesFor lists the tombstones stored for owner
+	TombstonesFor(owner string) ([]model.SyncEntry, error)
+	// UpdateExpiry sets the expiration timestamp of messages for owner by hash
+	// change is the signed request kept with the messages
+	// returns the hashes of the messages that were updated
+	UpdateExpiry(owner string, hashes [][]byte, expiresAt uint64, change *model.ExpiryChange) ([][]byte, error)
 	// Expire expires all old messages
 	Expire() error
 	// Mktemp generates a new temp file name
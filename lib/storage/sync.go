@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/majestrate/swarmserv/lib/model"
+)
+
+// buckets are the top level directories messages are spread over
+const buckets = "QWERTYUIOPASDFGHJKLZXCVBNM234567"
+
+func (s *fsSkiplistStore) BucketDigests() (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, r := range buckets {
+		bucket := string(r)
+		entries, err := s.BucketEntries(bucket)
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		for _, e := range entries {
+			expiration := e.ExpirationTimestamp
+			if e.Deleted {
+				// tombstone expirations are capped differently by each node so they would never match
+				expiration = 0
+			}
+			fmt.Fprintf(h, "%s %s %t %d\n", e.PubKey, e.Hash, e.Deleted, expiration)
+		}
+		digests[bucket] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
+
+func (s *fsSkiplistStore) BucketEntries(bucket string) ([]model.SyncEntry, error) {
+	if len(bucket) != 1 || !strings.Contains(buckets, bucket) {
+		return nil, fmt.Errorf("no such bucket: %s", bucket)
+	}
+	var entries []model.SyncEntry
+	p := filepath.Join(s.root, bucket)
+	dirs, err := readDirNames(p)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		entries = append(entries, dirEntries(filepath.Join(p, dir))...)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].PubKey == entries[j].PubKey {
+			return entries[i].Hash < entries[j].Hash
+		}
+		return entries[i].PubKey < entries[j].PubKey
+	})
+	return entries, nil
+}
+
+func (s *fsSkiplistStore) TombstonesFor(owner string) ([]model.SyncEntry, error) {
+	var tombstones []model.SyncEntry
+	bucket, dir := s.getSkiplistFor(owner)
+	for _, e := range dirEntries(filepath.Join(s.root, bucket, dir)) {
+		if e.Deleted && e.PubKey == owner {
+			tombstones = append(tombstones, e)
+		}
+	}
+	return tombstones, nil
+}
+
+// dirEntries lists the messages and tombstones in a skiplist directory that we know the owner of
+func dirEntries(p string) []model.SyncEntry {
+	var entries []model.SyncEntry
+	names, err := readDirNames(p)
+	if err != nil {
+		return nil
+	}
+	for _, name := range names {
+		if !strings.HasSuffix(name, metaSuffix) {
+			continue
+		}
+		msgname := strings.TrimSuffix(name, metaSuffix)
+		hash, err := enc.DecodeString(msgname)
+		if err != nil {
+			continue
+		}
+		meta, err := readMeta(filepath.Join(p, msgname))
+		if err != nil || meta.Owner == "" {
+			continue
+		}
+		if !meta.Deleted {
+			_, err = os.Stat(filepath.Join(p, msgname))
+			if err != nil {
+				continue
+			}
+		}
+		entries = append(entries, model.SyncEntry{
+			PubKey:              meta.Owner,
+			Hash:                hex.EncodeToString(hash),
+			ExpirationTimestamp: meta.ExpirationTimestamp,
+			Deleted:             meta.Deleted,
+			Deletion:            meta.Deletion,
+			ExpiryChange:        meta.ExpiryChange,
+		})
+	}
+	return entries
+}
+
+// readDirNames lists the names in a directory, a missing directory is empty
+func readDirNames(p string) ([]string, error) {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(0)
+}
@@ -0,0 +1,158 @@
+package swarm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/majestrate/swarmserv/lib/encode"
+)
+
+// ServiceNode is a service node in the network
+type ServiceNode struct {
+	// PubKey is the hex encoded ed25519 identity key
+	PubKey string `json:"pubkey_ed25519"`
+	// X25519 is the hex encoded x25519 key
+	X25519 string `json:"pubkey_x25519"`
+	// Address is the host the storage server is reachable at, defaults to the .snode address of PubKey
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	SwarmID uint64 `json:"swarm_id"`
+}
+
+// Host gets the host to connect to the service node's storage server at
+func (sn *ServiceNode) Host() string {
+	if sn.Address != "" {
+		return sn.Address
+	}
+	pk, err := hex.DecodeString(sn.PubKey)
+	if err != nil {
+		return ""
+	}
+	return encode.ZBase32Encoding.EncodeToString(pk) + ".snode"
+}
+
+// HostPort gets the host:port to connect to the service node's storage server at
+func (sn *ServiceNode) HostPort() string {
+	return net.JoinHostPort(sn.Host(), strconv.Itoa(sn.Port))
+}
+
+// Source provides the list of service nodes
+type Source interface {
+	// ServiceNodes fetches the current service node list
+	ServiceNodes() ([]ServiceNode, error)
+}
+
+// fileSource loads the service node list from a json file
+type fileSource struct {
+	path string
+}
+
+// NewFileSource creates a Source that reads a json array of ServiceNode from a file
+func NewFileSource(path string) Source {
+	return &fileSource{
+		path: path,
+	}
+}
+
+func (f *fileSource) ServiceNodes() ([]ServiceNode, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []ServiceNode
+	err = json.Unmarshal(data, &nodes)
+	return nodes, err
+}
+
+// lokidSource loads the service node list from lokid's json rpc
+type lokidSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewLokidSource creates a Source that calls get_n_service_nodes on a lokid compatible json rpc endpoint
+// url is the full url of the endpoint, i.e. http://127.0.0.1:22023/json_rpc
+func NewLokidSource(url string) Source {
+	return &lokidSource{
+		url: url,
+		client: &http.Client{
+			Timeout: time.Second * 10,
+		},
+	}
+}
+
+type lokidServiceNode struct {
+	ServiceNodePubKey string `json:"service_node_pubkey"`
+	PubKeyEd25519     string `json:"pubkey_ed25519"`
+	PubKeyX25519      string `json:"pubkey_x25519"`
+	SwarmID           uint64 `json:"swarm_id"`
+	StoragePort       int    `json:"storage_port"`
+}
+
+type lokidResponse struct {
+	Result *struct {
+		ServiceNodeStates []lokidServiceNode `json:"service_node_states"`
+	} `json:"result"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (l *lokidSource) ServiceNodes() ([]ServiceNode, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      "0",
+		"method":  "get_n_service_nodes",
+		"params": map[string]interface{}{
+			"fields": map[string]bool{
+				"service_node_pubkey": true,
+				"pubkey_ed25519":      true,
+				"pubkey_x25519":       true,
+				"swarm_id":            true,
+				"storage_port":        true,
+			},
+		},
+	})
+	resp, err := l.client.Post(l.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("lokid rpc returned http %d", resp.StatusCode)
+	}
+	var result lokidResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Error != nil {
+		return nil, fmt.Errorf("lokid rpc error %d: %s", result.Error.Code, result.Error.Message)
+	}
+	if result.Result == nil {
+		return nil, errors.New("lokid rpc returned no result")
+	}
+	var nodes []ServiceNode
+	for _, sn := range result.Result.ServiceNodeStates {
+		pk := sn.PubKeyEd25519
+		if pk == "" {
+			pk = sn.ServiceNodePubKey
+		}
+		nodes = append(nodes, ServiceNode{
+			PubKey:  pk,
+			X25519:  sn.PubKeyX25519,
+			Port:    sn.StoragePort,
+			SwarmID: sn.SwarmID,
+		})
+	}
+	return nodes, nil
+}
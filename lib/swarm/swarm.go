@@ -0,0 +1,213 @@
+package swarm
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InvalidSwarmID is the swarm id given to service nodes that are not in a swarm yet
+const InvalidSwarmID = ^uint64(0)
+
+// ErrInvalidPubKey is returned when a recipient public key cannot be mapped to a swarm
+var ErrInvalidPubKey = errors.New("invalid recipient public key")
+
+// ErrNoSwarms is returned when there are no swarms to map a recipient to
+var ErrNoSwarms = errors.New("no swarms known")
+
+// PubKeyToSwarmSpace maps a hex encoded recipient public key to a position in swarm id space
+// the key may have the 05 session id prefix
+func PubKeyToSwarmSpace(pubkey string) (uint64, error) {
+	if len(pubkey) == 66 && strings.HasPrefix(pubkey, "05") {
+		pubkey = pubkey[2:]
+	}
+	pk, err := hex.DecodeString(pubkey)
+	if err != nil || len(pk) != 32 {
+		return 0, ErrInvalidPubKey
+	}
+	var res uint64
+	for idx := 0; idx < 32; idx += 8 {
+		res ^= binary.BigEndian.Uint64(pk[idx:])
+	}
+	return res, nil
+}
+
+// ClosestSwarm gets the swarm id in swarmIDs that a recipient belongs to
+// this is the swarm id closest to the recipient's position in swarm space, wrapping around at the ends
+func ClosestSwarm(pubkey string, swarmIDs []uint64) (uint64, error) {
+	res, err := PubKeyToSwarmSpace(pubkey)
+	if err != nil {
+		return InvalidSwarmID, err
+	}
+	best := InvalidSwarmID
+	bestDist := ^uint64(0)
+	leftmost := ^uint64(0)
+	rightmost := uint64(0)
+	for _, id := range swarmIDs {
+		if id == InvalidSwarmID {
+			continue
+		}
+		var dist uint64
+		if id > res {
+			dist = id - res
+		} else {
+			dist = res - id
+		}
+		if dist < bestDist {
+			best = id
+			bestDist = dist
+		}
+		if id < leftmost {
+			leftmost = id
+		}
+		if id > rightmost {
+			rightmost = id
+		}
+	}
+	if best == InvalidSwarmID {
+		return InvalidSwarmID, ErrNoSwarms
+	}
+	// handle wrap around
+	if res > rightmost {
+		dist := (^uint64(0) - res) + leftmost
+		if dist < bestDist {
+			best = leftmost
+		}
+	} else if res < leftmost {
+		dist := res + (^uint64(0) - rightmost)
+		if dist < bestDist {
+			best = rightmost
+		}
+	}
+	return best, nil
+}
+
+// Swarm holds our view of the service node list and which swarm we are in
+type Swarm struct {
+	source     Source
+	ourPubKey  string
+	access     sync.RWMutex
+	nodes      []ServiceNode
+	swarmIDs   []uint64
+	lastUpdate time.Time
+}
+
+// New creates a swarm view loading service nodes from source, ourPubKey is our hex encoded ed25519 identity key
+func New(source Source, ourPubKey string) *Swarm {
+	return &Swarm{
+		source:    source,
+		ourPubKey: strings.ToLower(ourPubKey),
+	}
+}
+
+// Update reloads the service node list from our source
+func (s *Swarm) Update() error {
+	nodes, err := s.source.ServiceNodes()
+	if err != nil {
+		return err
+	}
+	seen := make(map[uint64]bool)
+	var ids []uint64
+	for idx := range nodes {
+		nodes[idx].PubKey = strings.ToLower(nodes[idx].PubKey)
+		id := nodes[idx].SwarmID
+		if id != InvalidSwarmID && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	s.access.Lock()
+	defer s.access.Unlock()
+	s.nodes = nodes
+	s.swarmIDs = ids
+	s.lastUpdate = time.Now()
+	return nil
+}
+
+// UpdateIfOlderThan reloads the service node list if it was last loaded more than maxAge ago
+func (s *Swarm) UpdateIfOlderThan(maxAge time.Duration) error {
+	s.access.RLock()
+	fresh := time.Since(s.lastUpdate) < maxAge
+	s.access.RUnlock()
+	if fresh {
+		return nil
+	}
+	return s.Update()
+}
+
+// Ready returns true if we have loaded a service node list with at least one swarm
+func (s *Swarm) Ready() bool {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return len(s.swarmIDs) > 0
+}
+
+// SwarmFor gets the swarm id a recipient belongs to
+func (s *Swarm) SwarmFor(pubkey string) (uint64, error) {
+	s.access.RLock()
+	defer s.access.RUnlock()
+	return ClosestSwarm(pubkey, s.swarmIDs)
+}
+
+// Lookup finds a service node by its hex encoded ed25519 public key
+func (s *Swarm) Lookup(pubkey string) (ServiceNode, bool) {
+	pubkey = strings.ToLower(pubkey)
+	s.access.RLock()
+	defer s.access.RUnlock()
+	for _, node := range s.nodes {
+		if node.PubKey == pubkey {
+			return node, true
+		}
+	}
+	return ServiceNode{}, false
+}
+
+// OurSwarm gets the id of the swarm we are in, returns false if we are not in one
+func (s *Swarm) OurSwarm() (uint64, bool) {
+	node, ok := s.Lookup(s.ourPubKey)
+	if !ok || node.SwarmID == InvalidSwarmID {
+		return InvalidSwarmID, false
+	}
+	return node.SwarmID, true
+}
+
+// MembersOf gets all service nodes in a swarm
+func (s *Swarm) MembersOf(swarmID uint64) []ServiceNode {
+	var members []ServiceNode
+	s.access.RLock()
+	defer s.access.RUnlock()
+	for _, node := range s.nodes {
+		if node.SwarmID == swarmID {
+			members = append(members, node)
+		}
+	}
+	return members
+}
+
+// Peers gets every other service node in our swarm
+func (s *Swarm) Peers() []ServiceNode {
+	var peers []ServiceNode
+	id, ok := s.OurSwarm()
+	if !ok {
+		return nil
+	}
+	for _, node := range s.MembersOf(id) {
+		if node.PubKey != s.ourPubKey {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
+
+// IsResponsibleFor returns true if a recipient belongs to our swarm
+func (s *Swarm) IsResponsibleFor(pubkey string) bool {
+	ours, ok := s.OurSwarm()
+	if !ok {
+		return false
+	}
+	id, err := s.SwarmFor(pubkey)
+	return err == nil && id == ours
+}
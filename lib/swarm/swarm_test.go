@@ -0,0 +1,38 @@
+package swarm
+
+import (
+	"testing"
+)
+
+func TestClosestSwarm(t *testing.T) {
+	swarms := []uint64{0x100, 0x1000, ^uint64(0) - 0x20, InvalidSwarmID}
+	tests := []struct {
+		pubkey string
+		swarm  uint64
+	}{
+		// closest by distance
+		{"0000000000000900000000000000000000000000000000000000000000000000", 0x1000},
+		{"0000000000000180000000000000000000000000000000000000000000000000", 0x100},
+		// wraps around the low end
+		{"0000000000000010000000000000000000000000000000000000000000000000", ^uint64(0) - 0x20},
+		// session id prefix and xor of all 4 words
+		{"050000000000000101000000000000010000000000000000000000000000000121", 0x100},
+	}
+	for _, test := range tests {
+		id, err := ClosestSwarm(test.pubkey, swarms)
+		if err != nil {
+			t.Fatalf("%s: %s", test.pubkey, err.Error())
+		}
+		if id != test.swarm {
+			t.Errorf("%s: got swarm %x expected %x", test.pubkey, id, test.swarm)
+		}
+	}
+	_, err := ClosestSwarm("00", swarms)
+	if err != ErrInvalidPubKey {
+		t.Errorf("expected invalid pubkey error, got %v", err)
+	}
+	_, err = ClosestSwarm(tests[0].pubkey, []uint64{InvalidSwarmID})
+	if err != ErrNoSwarms {
+		t.Errorf("expected no swarms error, got %v", err)
+	}
+}